@@ -0,0 +1,528 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// animation is an animated image uploaded with an id, played by the main loop.
+// Only touched from the main thread
+type animation struct {
+	// frames are whole frames the size of the image, already composed from the partial frames in the file
+	frames []image.Image
+	delays []time.Duration
+
+	// plays is the number of times the animation is played, 0 is forever
+	plays int
+
+	frame   int
+	playing bool
+	played  int
+
+	// due is when the next frame is shown
+	due time.Time
+}
+
+func (anim *animation) play() {
+	// a finished animation starts over
+	if !anim.playing && anim.plays != 0 && anim.played >= anim.plays {
+		anim.played = 0
+		anim.frame = 0
+	}
+
+	anim.playing = true
+	anim.due = time.Now().Add(anim.delays[anim.frame])
+}
+
+func (anim *animation) seek(frame int) {
+	if anim.plays != 0 && anim.played >= anim.plays {
+		anim.played = 0
+	}
+
+	anim.frame = frame
+	anim.due = time.Now().Add(anim.delays[frame])
+}
+
+// advance shows the frames that are due by now. Returns true if the frame changed, and finished is true
+// if the animation played its last frame
+func (anim *animation) advance(now time.Time) (changed, finished bool) {
+	for anim.playing && !now.Before(anim.due) {
+		if anim.frame == len(anim.frames)-1 {
+			anim.played++
+
+			if anim.plays != 0 && anim.played >= anim.plays {
+				anim.playing = false
+				return changed, true
+			}
+		}
+
+		anim.frame = (anim.frame + 1) % len(anim.frames)
+		anim.due = anim.due.Add(anim.delays[anim.frame])
+		changed = true
+
+		// a loop that fell far behind, like after the computer slept, starts again from now
+		if now.Sub(anim.due) > time.Second {
+			anim.due = now.Add(anim.delays[anim.frame])
+		}
+	}
+
+	return changed, false
+}
+
+// shownAnimations returns the animations shown in the cells of the screen, the panes and the visible layers.
+// Animations that are not shown are not played until they are
+func shownAnimations() map[*animation]bool {
+	shown := make(map[*animation]bool)
+
+	for _, g := range visibleGrids() {
+		for anim := range g.animations {
+			shown[anim] = true
+		}
+	}
+
+	return shown
+}
+
+// advanceAnimations moves the shown animations to their current frame and marks the grids showing them as changed,
+// sending an event for each one that finished
+func advanceAnimations() {
+	now := time.Now()
+	changed := make(map[*animation]bool)
+
+	for anim := range shownAnimations() {
+		frameChanged, finished := anim.advance(now)
+
+		if frameChanged {
+			changed[anim] = true
+		}
+
+		if !finished {
+			continue
+		}
+
+		for id, uploaded := range uploadedImages {
+			if uploaded.anim == anim {
+				sendResponse(animationEvent{Event: "animationFinished", ID: id})
+			}
+		}
+	}
+
+	for _, g := range visibleGrids() {
+		for anim := range g.animations {
+			if changed[anim] {
+				g.imagesDirty = true
+				break
+			}
+		}
+	}
+}
+
+// nextFrame returns how long until the next frame of any shown animation that is playing,
+// ok is false if none is playing
+func nextFrame() (wait time.Duration, ok bool) {
+	for anim := range shownAnimations() {
+		if !anim.playing {
+			continue
+		}
+
+		if until := time.Until(anim.due); !ok || until < wait {
+			wait, ok = until, true
+		}
+	}
+
+	return wait, ok
+}
+
+// animatedPlacement is an animation placed in a box, with its frames scaled to that box.
+// It is the image of the cells showing it, and looks like the current frame of the animation
+type animatedPlacement struct {
+	anim   *animation
+	frames []image.Image
+}
+
+func (p *animatedPlacement) current() image.Image {
+	return p.frames[p.anim.frame]
+}
+
+// version changes with the frame, which is when the texture is uploaded again
+func (p *animatedPlacement) version() int {
+	return p.anim.frame
+}
+
+func (p *animatedPlacement) ColorModel() color.Model {
+	return p.current().ColorModel()
+}
+
+func (p *animatedPlacement) Bounds() image.Rectangle {
+	return p.current().Bounds()
+}
+
+func (p *animatedPlacement) At(x, y int) color.Color {
+	return p.current().At(x, y)
+}
+
+// decodeGIF returns the frames of an animated gif, or nil if it has a single frame.
+// Every frame is composed into a whole frame, so the frames are counted before decoding to bound their pixels
+func decodeGIF(data []byte) (*animation, error) {
+	config, err := gif.DecodeConfig(bytes.NewReader(data))
+
+	if err != nil {
+		return nil, err
+	}
+
+	count, err := countGIFFrames(data)
+
+	if err != nil {
+		return nil, err
+	} else if count < 2 {
+		return nil, nil
+	} else if !fitsPixels(config.Width, config.Height, count) {
+		return nil, errors.Errorf("animated gif of %d frames of %d x %d pixels has more than %d pixels in all",
+			count, config.Width, config.Height, maxImagePixels)
+	}
+
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+
+	if err != nil {
+		return nil, err
+	}
+
+	anim := &animation{playing: true}
+
+	switch g.LoopCount {
+	case 0:
+		anim.plays = 0
+	case -1:
+		anim.plays = 1
+	default:
+		anim.plays = g.LoopCount + 1
+	}
+
+	canvas := image.NewNRGBA(image.Rect(0, 0, g.Config.Width, g.Config.Height))
+
+	for i, frame := range g.Image {
+		var previous *image.NRGBA
+
+		if g.Disposal != nil && g.Disposal[i] == gif.DisposalPrevious {
+			previous = image.NewNRGBA(canvas.Rect)
+			copy(previous.Pix, canvas.Pix)
+		}
+
+		draw.Draw(canvas, frame.Rect, frame, frame.Rect.Min, draw.Over)
+
+		composed := image.NewNRGBA(canvas.Rect)
+		copy(composed.Pix, canvas.Pix)
+		anim.frames = append(anim.frames, composed)
+
+		// like browsers, delays of 0 or 10ms are shown for 100ms
+		delay := g.Delay[i]
+
+		if delay < 2 {
+			delay = 10
+		}
+
+		anim.delays = append(anim.delays, time.Duration(delay)*10*time.Millisecond)
+
+		if previous != nil {
+			canvas = previous
+		} else if g.Disposal != nil && g.Disposal[i] == gif.DisposalBackground {
+			draw.Draw(canvas, frame.Rect, image.Transparent, image.Point{}, draw.Src)
+		}
+	}
+
+	return anim, nil
+}
+
+// countGIFFrames counts the images in a gif by going through its blocks, without decoding them
+func countGIFFrames(data []byte) (int, error) {
+	invalid := errors.New("invalid gif")
+
+	// the size of a color table, which follows the logical screen or image descriptor when the top bit of its flags is set
+	colorTable := func(flags byte) int {
+		if flags&0x80 == 0 {
+			return 0
+		}
+
+		return 3 << (flags&7 + 1)
+	}
+
+	// skipBlocks returns the position after the data sub-blocks starting at pos
+	skipBlocks := func(pos int) (int, error) {
+		for pos < len(data) {
+			size := int(data[pos])
+			pos++
+
+			if size == 0 {
+				return pos, nil
+			}
+
+			pos += size
+		}
+
+		return 0, invalid
+	}
+
+	if len(data) < 13 {
+		return 0, invalid
+	}
+
+	pos, count := 13+colorTable(data[10]), 0
+	var err error
+
+	for pos < len(data) {
+		switch data[pos] {
+		case 0x21:
+			// an extension, its label followed by sub-blocks
+			pos, err = skipBlocks(pos + 2)
+		case 0x2c:
+			// an image descriptor followed by the minimum code size of the image data and its sub-blocks
+			if pos+10 > len(data) {
+				return 0, invalid
+			}
+
+			count++
+			pos, err = skipBlocks(pos + 10 + colorTable(data[pos+9]) + 1)
+		case 0x3b:
+			return count, nil
+		default:
+			return 0, invalid
+		}
+
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	// like the gif package, a file cut off after its last image is accepted
+	return count, nil
+}
+
+// decodeAPNG returns the frames of an animated png, or nil if it is a still png. Each frame is turned into a png
+// of its own with the header and ancillary chunks of the file, and decoded with the png package
+func decodeAPNG(data []byte) (*animation, error) {
+	invalid := errors.New("invalid animated png")
+	be := binary.BigEndian
+
+	type pngChunk struct {
+		kind string
+		data []byte
+	}
+
+	type apngFrame struct {
+		rect    image.Rectangle
+		delay   time.Duration
+		dispose byte
+		blend   byte
+		data    [][]byte
+	}
+
+	var header []byte
+	var ancillary []pngChunk
+	var frames []*apngFrame
+	var current *apngFrame
+	anim := &animation{playing: true}
+	animated := false
+
+	for pos := 8; pos+12 <= len(data); {
+		length := int(be.Uint32(data[pos:]))
+
+		if length < 0 || pos+12+length > len(data) {
+			return nil, invalid
+		}
+
+		kind, chunk := string(data[pos+4:pos+8]), data[pos+8:pos+8+length]
+		pos += 12 + length
+
+		switch kind {
+		case "IHDR":
+			header = chunk
+		case "acTL":
+			if len(chunk) < 8 {
+				return nil, invalid
+			}
+
+			animated = true
+			anim.plays = int(be.Uint32(chunk[4:]))
+		case "fcTL":
+			if len(chunk) < 26 {
+				return nil, invalid
+			}
+
+			x, y := int(be.Uint32(chunk[12:])), int(be.Uint32(chunk[16:]))
+			numerator, denominator := time.Duration(be.Uint16(chunk[20:])), time.Duration(be.Uint16(chunk[22:]))
+
+			if denominator == 0 {
+				denominator = 100
+			}
+
+			// like browsers, delays of 10ms or less are shown for 100ms
+			delay := numerator * time.Second / denominator
+
+			if delay <= 10*time.Millisecond {
+				delay = 100 * time.Millisecond
+			}
+
+			current = &apngFrame{
+				rect:    image.Rect(x, y, x+int(be.Uint32(chunk[4:])), y+int(be.Uint32(chunk[8:]))),
+				delay:   delay,
+				dispose: chunk[24],
+				blend:   chunk[25],
+			}
+			frames = append(frames, current)
+		case "IDAT":
+			// the default image is only part of the animation when a frame control chunk comes before it
+			if current != nil {
+				current.data = append(current.data, chunk)
+			}
+		case "fdAT":
+			if current == nil || len(chunk) < 4 {
+				return nil, invalid
+			}
+
+			current.data = append(current.data, chunk[4:])
+		case "IEND":
+		default:
+			if len(frames) == 0 {
+				ancillary = append(ancillary, pngChunk{kind: kind, data: chunk})
+			}
+		}
+	}
+
+	if !animated || len(frames) < 2 {
+		return nil, nil
+	}
+
+	if len(header) < 13 {
+		return nil, invalid
+	}
+
+	// every frame is composed into a whole frame the size of the image
+	width, height := int(be.Uint32(header)), int(be.Uint32(header[4:]))
+
+	if !fitsPixels(width, height, len(frames)) {
+		return nil, errors.Errorf("animated png of %d frames of %d x %d pixels has more than %d pixels in all",
+			len(frames), width, height, maxImagePixels)
+	}
+
+	writeChunk := func(buf *bytes.Buffer, kind string, chunk []byte) {
+		var head [8]byte
+		be.PutUint32(head[:], uint32(len(chunk)))
+		copy(head[4:], kind)
+		buf.Write(head[:])
+		buf.Write(chunk)
+
+		crc := crc32.NewIEEE()
+		crc.Write(head[4:])
+		crc.Write(chunk)
+		_ = binary.Write(buf, be, crc.Sum32())
+	}
+
+	canvas := image.NewNRGBA(image.Rect(0, 0, width, height))
+
+	for _, frame := range frames {
+		if !frame.rect.In(canvas.Rect) {
+			return nil, invalid
+		}
+
+		var buf bytes.Buffer
+		buf.Write(data[:8])
+
+		frameHeader := append([]byte(nil), header...)
+		be.PutUint32(frameHeader, uint32(frame.rect.Dx()))
+		be.PutUint32(frameHeader[4:], uint32(frame.rect.Dy()))
+		writeChunk(&buf, "IHDR", frameHeader)
+
+		for _, chunk := range ancillary {
+			writeChunk(&buf, chunk.kind, chunk.data)
+		}
+
+		for _, chunk := range frame.data {
+			writeChunk(&buf, "IDAT", chunk)
+		}
+
+		writeChunk(&buf, "IEND", nil)
+		img, err := png.Decode(&buf)
+
+		if err != nil {
+			return nil, errors.WithMessage(err, "invalid animated png frame")
+		}
+
+		var previous *image.NRGBA
+
+		if frame.dispose == 2 {
+			previous = image.NewNRGBA(canvas.Rect)
+			copy(previous.Pix, canvas.Pix)
+		}
+
+		op := draw.Over
+
+		if frame.blend == 0 {
+			op = draw.Src
+		}
+
+		draw.Draw(canvas, frame.rect, img, img.Bounds().Min, op)
+
+		composed := image.NewNRGBA(canvas.Rect)
+		copy(composed.Pix, canvas.Pix)
+		anim.frames = append(anim.frames, composed)
+		anim.delays = append(anim.delays, frame.delay)
+
+		if previous != nil {
+			canvas = previous
+		} else if frame.dispose == 1 {
+			draw.Draw(canvas, frame.rect, image.Transparent, image.Point{}, draw.Src)
+		}
+	}
+
+	return anim, nil
+}
+
+// animationDrawRequest plays, pauses or seeks the animation of an uploaded image
+type animationDrawRequest struct {
+	action string
+	id     string
+	frame  int
+}
+
+func (req animationDrawRequest) apply(*grid) {
+	uploaded, ok := uploadedImages[req.id]
+
+	if !ok {
+		sendError(errors.Errorf("%s request got unknown id %q", req.action, req.id))
+		return
+	} else if uploaded.anim == nil {
+		sendError(errors.Errorf("%s request got image %q which is not animated", req.action, req.id))
+		return
+	}
+
+	anim := uploaded.anim
+
+	switch req.action {
+	case "play":
+		anim.play()
+	case "pause":
+		anim.playing = false
+	case "seek":
+		if req.frame >= len(anim.frames) {
+			sendError(errors.Errorf("seek request got frame %d, image %q has %d frames", req.frame, req.id, len(anim.frames)))
+			return
+		}
+
+		anim.seek(req.frame)
+	}
+
+	for _, g := range grids() {
+		if g.animations[anim] > 0 {
+			g.imagesDirty = true
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"testing"
+)
+
+// encodeGIF returns a gif of width x height pixels with the given number of 1 x 1 frames
+func encodeGIF(t *testing.T, width, height, frames int) []byte {
+	g := &gif.GIF{Config: image.Config{Width: width, Height: height, ColorModel: color.Palette{color.Black, color.White}}}
+
+	for i := 0; i < frames; i++ {
+		g.Image = append(g.Image, image.NewPaletted(image.Rect(0, 0, 1, 1), color.Palette{color.Black, color.White}))
+		g.Delay = append(g.Delay, 10)
+	}
+
+	var buf bytes.Buffer
+
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestCountGIFFrames(t *testing.T) {
+	three := encodeGIF(t, 4, 4, 3)
+
+	tests := []struct {
+		name  string
+		data  []byte
+		count int
+		ok    bool
+	}{
+		{"one frame", encodeGIF(t, 4, 4, 1), 1, true},
+		{"three frames", three, 3, true},
+		{"without trailer", three[:len(three)-1], 3, true},
+		{"cut off in an image", three[:len(three)-4], 0, false},
+		{"header only", three[:13], 0, true},
+		{"too short", three[:12], 0, false},
+		{"garbage instead of trailer", append(append([]byte{}, three[:len(three)-1]...), 0x42), 0, false},
+	}
+
+	for _, test := range tests {
+		count, err := countGIFFrames(test.data)
+
+		if (err == nil) != test.ok {
+			t.Errorf("%s got error %v, want ok: %t", test.name, err, test.ok)
+		} else if count != test.count {
+			t.Errorf("%s got %d frames, want %d", test.name, count, test.count)
+		}
+	}
+}
+
+func TestDecodeGIF(t *testing.T) {
+	tests := []struct {
+		name                  string
+		width, height, frames int
+		animated, ok          bool
+	}{
+		{"still", 4, 4, 1, false, true},
+		{"animated", 4, 4, 3, true, true},
+		{"large frames", 4096, 4096, 4, true, true},
+		{"too many pixels in all", 4096, 4096, 5, false, false},
+	}
+
+	for _, test := range tests {
+		anim, err := decodeGIF(encodeGIF(t, test.width, test.height, test.frames))
+
+		if (err == nil) != test.ok {
+			t.Errorf("%s got error %v, want ok: %t", test.name, err, test.ok)
+		} else if (anim != nil) != test.animated {
+			t.Errorf("%s got animation %t, want %t", test.name, anim != nil, test.animated)
+		} else if anim != nil && len(anim.frames) != test.frames {
+			t.Errorf("%s got %d frames, want %d", test.name, len(anim.frames), test.frames)
+		}
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"image"
+	"image/draw"
+	"math"
+	"unicode"
+
+	"github.com/go-gl/gl/v2.1/gl"
+	"golang.org/x/image/font"
+	"golang.org/x/image/math/fixed"
+)
+
+// the atlas starts at minAtlasSize and doubles for large cells until at least minAtlasSlots glyphs fit,
+// fonts with cells too large for that at maxAtlasSize are refused
+const (
+	minAtlasSize  = 2048
+	maxAtlasSize  = 8192
+	minAtlasSlots = 128
+)
+
+// the first slots of the atlas are not glyphs, but shapes drawn over the whole cell
+const (
+	slotSolid = iota
+	slotUnderline
+	slotDoubleUnderline
+	slotCurlyUnderline
+	slotStrikethrough
+	firstGlyphSlot
+)
+
+// italic glyphs are slanted by this much when there is no italic face
+const slant = 0.2
+
+type glyphKey struct {
+	char      rune
+	combining string
+	face      attributes
+	wide      bool
+
+	// shaped holds the encoded glyph pieces of a shaped cell, char is then not used
+	shaped string
+}
+
+// atlasGlyph is where a glyph is in the atlas. Colored glyphs are drawn as they are, other glyphs are white
+// and get the text color when drawn
+type atlasGlyph struct {
+	slot    int
+	colored bool
+}
+
+// glyphAtlas is a texture holding every glyph drawn so far, each rasterized once into a cell sized slot.
+// The slots before firstGlyphSlot hold backgrounds and lines, so they can be drawn from the same texture as the glyphs.
+type glyphAtlas struct {
+	texture uint32
+	size    int
+	slots   map[glyphKey]atlasGlyph
+	next    int
+
+	// generation is bumped on every reset, slots handed out before that are no longer valid
+	generation int
+
+	// the fontGeneration the glyphs were drawn with
+	fontGeneration int
+}
+
+func newGlyphAtlas() *glyphAtlas {
+	atlas := &glyphAtlas{}
+
+	gl.GenTextures(1, &atlas.texture)
+	gl.BindTexture(gl.TEXTURE_2D, atlas.texture)
+	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MIN_FILTER, gl.NEAREST)
+	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MAG_FILTER, gl.NEAREST)
+	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_WRAP_S, gl.CLAMP_TO_EDGE)
+	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_WRAP_T, gl.CLAMP_TO_EDGE)
+
+	atlas.reset()
+	return atlas
+}
+
+// atlasSizeFor returns the size of the smallest atlas with at least minAtlasSlots slots for cells of
+// width x height, false if not even an atlas of maxAtlasSize has that many
+func atlasSizeFor(width, height int) (int, bool) {
+	if width <= 0 || height <= 0 {
+		return 0, false
+	}
+
+	for size := minAtlasSize; size <= maxAtlasSize; size *= 2 {
+		if (size/width)*(size/height) >= minAtlasSlots {
+			return size, true
+		}
+	}
+
+	return 0, false
+}
+
+// reset throws away all glyphs, used when the atlas is full or the font changed.
+// The texture is allocated again when the cells need an atlas of another size
+func (atlas *glyphAtlas) reset() {
+	if size, ok := atlasSizeFor(colWidth, rowHeight); !ok {
+		atlas.resize(maxAtlasSize)
+	} else {
+		atlas.resize(size)
+	}
+
+	atlas.slots = make(map[glyphKey]atlasGlyph)
+	atlas.next = firstGlyphSlot
+	atlas.generation++
+	atlas.fontGeneration = fontGeneration
+
+	thickness := lineThickness
+
+	solid := image.NewAlpha(image.Rect(0, 0, colWidth, rowHeight))
+	draw.Draw(solid, solid.Rect, image.Opaque, image.Point{}, draw.Src)
+	atlas.upload(slotSolid, solid)
+
+	// keeps a line of the given thickness inside the cell
+	line := func(img *image.Alpha, y int) {
+		if y+thickness > rowHeight {
+			y = rowHeight - thickness
+		}
+
+		draw.Draw(img, image.Rect(0, y, colWidth, y+thickness), image.Opaque, image.Point{}, draw.Src)
+	}
+
+	underline := image.NewAlpha(solid.Rect)
+	line(underline, underlinePosition)
+	atlas.upload(slotUnderline, underline)
+
+	double := image.NewAlpha(solid.Rect)
+	line(double, underlinePosition+2*thickness)
+	line(double, underlinePosition)
+	atlas.upload(slotDoubleUnderline, double)
+
+	// one period of a sine wave per cell, so it continues seamlessly into the next one
+	curly := image.NewAlpha(solid.Rect)
+	amplitude := float64(thickness)
+
+	for x := 0; x < colWidth; x++ {
+		center := float64(underlinePosition+thickness) + amplitude*math.Sin(2*math.Pi*float64(x)/float64(colWidth))
+		y := int(center)
+
+		if y+thickness > rowHeight {
+			y = rowHeight - thickness
+		}
+
+		draw.Draw(curly, image.Rect(x, y, x+1, y+thickness), image.Opaque, image.Point{}, draw.Src)
+	}
+
+	atlas.upload(slotCurlyUnderline, curly)
+
+	strikethrough := image.NewAlpha(solid.Rect)
+	line(strikethrough, strikethroughPosition)
+	atlas.upload(slotStrikethrough, strikethrough)
+}
+
+// resize allocates the texture at size x size, when it is not that size already
+func (atlas *glyphAtlas) resize(size int) {
+	if size == atlas.size {
+		return
+	}
+
+	atlas.size = size
+	gl.BindTexture(gl.TEXTURE_2D, atlas.texture)
+	gl.TexImage2D(gl.TEXTURE_2D, 0, gl.RGBA, int32(size), int32(size), 0, gl.RGBA, gl.UNSIGNED_BYTE, nil)
+}
+
+func (atlas *glyphAtlas) capacity() int {
+	return (atlas.size / colWidth) * (atlas.size / rowHeight)
+}
+
+func (atlas *glyphAtlas) slotRect(slot int) image.Rectangle {
+	perRow := atlas.size / colWidth
+	x := (slot % perRow) * colWidth
+	y := (slot / perRow) * rowHeight
+	return image.Rect(x, y, x+colWidth, y+rowHeight)
+}
+
+// texCoords returns the texture coordinates for the top left and bottom right corner of a slot
+func (atlas *glyphAtlas) texCoords(slot int) (u0, v0, u1, v1 float32) {
+	r := atlas.slotRect(slot)
+	size := float32(atlas.size)
+	return float32(r.Min.X) / size, float32(r.Min.Y) / size,
+		float32(r.Max.X) / size, float32(r.Max.Y) / size
+}
+
+// glyph returns the slot of the glyph, rasterizing it into the atlas the first time it is seen.
+// Wide glyphs take two slots, the left half in the returned slot and the right half in the one after it
+func (atlas *glyphAtlas) glyph(char rune, combining string, attrs attributes) atlasGlyph {
+	key := glyphKey{char: char, combining: combining, face: attrs & attrFace, wide: attrs&attrWidth != 0}
+
+	if glyph, ok := atlas.slots[key]; ok {
+		return glyph
+	}
+
+	slots := 1
+
+	if key.wide {
+		slots = 2
+	}
+
+	if atlas.next+slots > atlas.capacity() {
+		atlas.reset()
+	}
+
+	glyph := atlasGlyph{slot: atlas.next}
+	atlas.next += slots
+	width := colWidth * slots
+
+	if img := boxGlyph(char, width, rowHeight); img != nil {
+		atlas.slots[key] = glyph
+		atlas.uploadSlots(glyph.slot, img)
+		return glyph
+	}
+
+	if emojiFont != nil && coloredCluster(char, combining, key.wide) {
+		if img := emojiFont.draw(string(char)+combining, width, rowHeight); img != nil {
+			glyph.colored = true
+			atlas.slots[key] = glyph
+
+			for i := 0; i < slots; i++ {
+				half := image.NewNRGBA(image.Rect(0, 0, colWidth, rowHeight))
+				draw.Draw(half, half.Rect, img, image.Pt(i*colWidth, 0), draw.Src)
+				atlas.uploadColored(glyph.slot+i, half)
+			}
+
+			return glyph
+		}
+	}
+
+	atlas.slots[key] = glyph
+	atlas.uploadSlots(glyph.slot, rasterizeGlyph(char, combining, key.face, width))
+	return glyph
+}
+
+// shapedGlyph returns the slot of a cell drawn by the shaping stage, rasterizing it the first time it is seen
+func (atlas *glyphAtlas) shapedGlyph(pieces string, attrs attributes) atlasGlyph {
+	key := glyphKey{shaped: pieces, face: attrs & attrFace}
+
+	if glyph, ok := atlas.slots[key]; ok {
+		return glyph
+	}
+
+	if atlas.next >= atlas.capacity() {
+		atlas.reset()
+	}
+
+	glyph := atlasGlyph{slot: atlas.next}
+	atlas.next++
+	atlas.slots[key] = glyph
+	atlas.upload(glyph.slot, rasterizePieces(decodePieces(pieces), key.face))
+
+	return glyph
+}
+
+// rasterizeGlyph draws a character with its combining marks from the font, into an image width wide and a row high
+func rasterizeGlyph(char rune, combining string, attrs attributes, width int) *image.Alpha {
+	face, slanted := glyphFace(char, attrs)
+	img := image.NewAlpha(image.Rect(0, 0, width, rowHeight))
+
+	drawer := font.Drawer{
+		Dst:  img,
+		Src:  image.Opaque,
+		Face: face,
+		Dot:  fixed.P(0, baseline),
+	}
+
+	drawer.DrawString(string(char))
+
+	// combining marks are centered over the character, the rest of the cluster like zero width joiners
+	// and variation selectors can not be drawn without shaping and is left out
+	for _, mark := range combining {
+		if !unicode.In(mark, unicode.Mn, unicode.Me) {
+			continue
+		}
+
+		markFace, _ := glyphFace(mark, attrs)
+		bounds, _, ok := markFace.GlyphBounds(mark)
+
+		if !ok {
+			continue
+		}
+
+		drawer.Face = markFace
+		drawer.Dot = fixed.Point26_6{X: (fixed.I(width) - bounds.Min.X - bounds.Max.X) / 2, Y: fixed.I(baseline)}
+		drawer.DrawString(string(mark))
+	}
+
+	if slanted {
+		img = slantGlyph(img, baseline)
+	}
+
+	return img
+}
+
+// slantGlyph shears a glyph to the right above the baseline and to the left below it
+func slantGlyph(img *image.Alpha, baseline int) *image.Alpha {
+	slanted := image.NewAlpha(img.Rect)
+
+	for y := 0; y < img.Rect.Dy(); y++ {
+		shift := int(math.Round(float64(baseline-y) * slant))
+		dst := slanted.Pix[y*slanted.Stride : y*slanted.Stride+img.Rect.Dx()]
+		src := img.Pix[y*img.Stride : y*img.Stride+img.Rect.Dx()]
+
+		for x, alpha := range src {
+			if x+shift >= 0 && x+shift < len(dst) {
+				dst[x+shift] = alpha
+			}
+		}
+	}
+
+	return slanted
+}
+
+// uploadSlots splits an image one or more cells wide into the slots starting at slot
+func (atlas *glyphAtlas) uploadSlots(slot int, img *image.Alpha) {
+	for i := 0; i*colWidth < img.Rect.Dx(); i++ {
+		cell := image.NewAlpha(image.Rect(0, 0, colWidth, rowHeight))
+		draw.Draw(cell, cell.Rect, img, image.Pt(i*colWidth, 0), draw.Src)
+		atlas.upload(slot+i, cell)
+	}
+}
+
+// upload puts a white glyph with the coverage of img as alpha into a slot
+func (atlas *glyphAtlas) upload(slot int, img *image.Alpha) {
+	white := image.NewNRGBA(img.Rect)
+
+	for i, alpha := range img.Pix {
+		copy(white.Pix[i*4:], []uint8{255, 255, 255, alpha})
+	}
+
+	atlas.uploadColored(slot, white)
+}
+
+func (atlas *glyphAtlas) uploadColored(slot int, img *image.NRGBA) {
+	r := atlas.slotRect(slot)
+
+	gl.BindTexture(gl.TEXTURE_2D, atlas.texture)
+	gl.PixelStorei(gl.UNPACK_ALIGNMENT, 1)
+	gl.TexSubImage2D(gl.TEXTURE_2D, 0, int32(r.Min.X), int32(r.Min.Y), int32(r.Dx()), int32(r.Dy()),
+		gl.RGBA, gl.UNSIGNED_BYTE, gl.Ptr(img.Pix))
+}
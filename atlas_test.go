@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestAtlasSizeFor(t *testing.T) {
+	tests := []struct {
+		width, height int
+		size          int
+		ok            bool
+	}{
+		{10, 20, 2048, true},
+		{150, 300, 4096, true},
+		{241, 466, 4096, true},
+		{500, 1000, 8192, true},
+		{241, 1864, 8192, true},
+		{241, 2100, 0, false},
+		{3000, 20, 4096, true},
+		{9000, 20, 0, false},
+		{0, 20, 0, false},
+	}
+
+	for _, test := range tests {
+		size, ok := atlasSizeFor(test.width, test.height)
+
+		if ok != test.ok || size != test.size {
+			t.Errorf("atlasSizeFor(%d, %d) = %d, %t, want %d, %t", test.width, test.height, size, ok, test.size, test.ok)
+		}
+	}
+}
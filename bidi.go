@@ -0,0 +1,485 @@
+package main
+
+import (
+	"sort"
+
+	"golang.org/x/text/unicode/bidi"
+)
+
+// maxBracketDepth is how many brackets can be open at once when pairing them, as in the algorithm
+const maxBracketDepth = 63
+
+// bidiLayout is the order a row with right to left text is drawn in. The grid keeps cells in logical order,
+// the order they are read in, and rows are reordered with the Unicode Bidirectional Algorithm when drawn.
+//
+// Each row is a left to right paragraph. Runs of cells sent with a direction are isolates in it, laid out in that
+// direction without affecting the text around them, while cells with the default auto direction take part in the
+// paragraph itself. Brackets are paired, and whitespace at the end of the row or before a tab is reset to the
+// paragraph level, except in cells sent with a direction so a row sent right to left stays right aligned.
+// Explicit embeddings, overrides and isolates written as formatting characters are not supported, those characters
+// are neutrals and the direction attribute takes their place. Each row is laid out on its own, a paragraph is never
+// wrapped over several rows
+type bidiLayout struct {
+	// visual[col] is the logical column drawn at col
+	visual []int
+
+	// the embedding level of each logical column, odd levels are right to left
+	levels []uint8
+}
+
+// cell returns the cell drawn at the visual column col, with its character mirrored in right to left text
+func (l *bidiLayout) cell(cells []cell, col int) cell {
+	c := cells[l.visual[col]]
+
+	if l.levels[l.visual[col]]%2 == 1 {
+		c.char = mirror(c.char)
+	}
+
+	return c
+}
+
+// layoutRow returns the visual order of a row, or nil if it is drawn as it is
+func layoutRow(cells []cell) *bidiLayout {
+	rtl := false
+
+	for _, c := range cells {
+		if c.attrs&attrRTL != 0 || strongRTL(c.char) {
+			rtl = true
+			break
+		}
+	}
+
+	if !rtl {
+		return nil
+	}
+
+	levels := make([]uint8, len(cells))
+	outer := bidiSequence{}
+
+	for col := 0; col < len(cells); {
+		dir := cells[col].attrs & attrDirection
+
+		if dir == 0 {
+			outer.add(col, cells[col].char, cellClass(cells[col]))
+			col++
+			continue
+		}
+
+		end := col + 1
+
+		for end < len(cells) && cells[end].attrs&attrDirection == dir {
+			end++
+		}
+
+		isolate := bidiSequence{level: 1}
+
+		if dir == attrLTR {
+			isolate.level = 2
+		}
+
+		for i := col; i < end; i++ {
+			isolate.add(i, cells[i].char, cellClass(cells[i]))
+		}
+
+		isolate.resolve(levels)
+
+		// to the text around it an isolate is a neutral, like the isolate initiator and terminator around it
+		outer.add(-1, 0, bidi.PDI)
+		col = end
+	}
+
+	outer.resolve(levels)
+
+	// L1: whitespace at the end of the row and before a tab is at the paragraph level
+	trailing := true
+
+	for col := len(cells) - 1; col >= 0; col-- {
+		if cells[col].attrs&attrDirection != 0 {
+			trailing = false
+			continue
+		}
+
+		switch cellClass(cells[col]) {
+		case bidi.S:
+			levels[col] = 0
+			trailing = true
+		case bidi.WS:
+			if trailing {
+				levels[col] = 0
+			}
+		default:
+			trailing = false
+		}
+	}
+
+	// both halves of a wide character are moved together and kept in their order
+	var units []span
+	highest, lowestOdd := uint8(0), uint8(255)
+
+	for col := 0; col < len(cells); col++ {
+		unit := span{from: col, to: col + 1}
+
+		if cells[col].attrs&attrWide != 0 && col+1 < len(cells) && cells[col+1].attrs&attrContinuation != 0 {
+			unit.to++
+			col++
+		}
+
+		units = append(units, unit)
+		level := levels[unit.from]
+
+		if level > highest {
+			highest = level
+		}
+
+		if level%2 == 1 && level < lowestOdd {
+			lowestOdd = level
+		}
+	}
+
+	if lowestOdd == 255 {
+		return nil
+	}
+
+	for level := highest; level >= lowestOdd; level-- {
+		for i := 0; i < len(units); {
+			if levels[units[i].from] < level {
+				i++
+				continue
+			}
+
+			end := i + 1
+
+			for end < len(units) && levels[units[end].from] >= level {
+				end++
+			}
+
+			for a, b := i, end-1; a < b; a, b = a+1, b-1 {
+				units[a], units[b] = units[b], units[a]
+			}
+
+			i = end
+		}
+	}
+
+	layout := &bidiLayout{visual: make([]int, 0, len(cells)), levels: levels}
+
+	for _, unit := range units {
+		for col := unit.from; col < unit.to; col++ {
+			layout.visual = append(layout.visual, col)
+		}
+	}
+
+	return layout
+}
+
+// bidiSequence is an isolating run sequence, cells at the same level resolved together
+type bidiSequence struct {
+	level uint8
+
+	// the column of each character, -1 for isolates
+	cols  []int
+	chars []rune
+	types []bidi.Class
+}
+
+func (s *bidiSequence) add(col int, char rune, class bidi.Class) {
+	s.cols = append(s.cols, col)
+	s.chars = append(s.chars, char)
+	s.types = append(s.types, class)
+}
+
+// bracketPairs returns the positions of the opening and closing brackets that pair up, ordered by the opening one.
+// Only brackets still neutral after the weak rules are paired
+func (s *bidiSequence) bracketPairs() [][2]int {
+	type opening struct {
+		closing rune
+		pos     int
+	}
+
+	var open []opening
+	var pairs [][2]int
+
+	for i, char := range s.chars {
+		if s.types[i] != bidi.ON {
+			continue
+		}
+
+		props, _ := bidi.LookupRune(char)
+
+		if !props.IsBracket() {
+			continue
+		} else if props.IsOpeningBracket() {
+			if len(open) == maxBracketDepth {
+				break
+			}
+
+			open = append(open, opening{closing: mirror(char), pos: i})
+			continue
+		}
+
+		// a closing bracket closes the nearest opening bracket of its kind, and every bracket opened after that
+		for j := len(open) - 1; j >= 0; j-- {
+			if open[j].closing == char {
+				pairs = append(pairs, [2]int{open[j].pos, i})
+				open = open[:j]
+				break
+			}
+		}
+	}
+
+	sort.Slice(pairs, func(a, b int) bool { return pairs[a][0] < pairs[b][0] })
+	return pairs
+}
+
+// resolve runs the weak, neutral and implicit rules of the algorithm and sets the level of each column
+func (s *bidiSequence) resolve(levels []uint8) {
+	t := s.types
+	original := append([]bidi.Class(nil), t...)
+
+	// the direction of the sequence, also used as the start and end of sequence types
+	e := bidi.L
+
+	if s.level%2 == 1 {
+		e = bidi.R
+	}
+
+	// W1: nonspacing marks take the type of the character before them
+	for i := range t {
+		if t[i] != bidi.NSM {
+			continue
+		}
+
+		if i == 0 {
+			t[i] = e
+		} else if t[i-1] == bidi.PDI {
+			t[i] = bidi.ON
+		} else {
+			t[i] = t[i-1]
+		}
+	}
+
+	// W2 & W3: european numbers after arabic letters are arabic numbers, and arabic letters are right to left
+	last := e
+
+	for i, class := range t {
+		switch class {
+		case bidi.L, bidi.R, bidi.AL:
+			last = class
+		case bidi.EN:
+			if last == bidi.AL {
+				t[i] = bidi.AN
+			}
+		}
+	}
+
+	for i := range t {
+		if t[i] == bidi.AL {
+			t[i] = bidi.R
+		}
+	}
+
+	// W4: a single separator between two numbers of the same type joins them
+	for i := 1; i+1 < len(t); i++ {
+		if t[i] == bidi.ES && t[i-1] == bidi.EN && t[i+1] == bidi.EN {
+			t[i] = bidi.EN
+		} else if t[i] == bidi.CS && (t[i-1] == bidi.EN || t[i-1] == bidi.AN) && t[i+1] == t[i-1] {
+			t[i] = t[i-1]
+		}
+	}
+
+	// W5: terminators next to european numbers, like currency signs, are part of the number
+	for i := 0; i < len(t); {
+		if t[i] != bidi.ET {
+			i++
+			continue
+		}
+
+		end := i + 1
+
+		for end < len(t) && t[end] == bidi.ET {
+			end++
+		}
+
+		if (i > 0 && t[i-1] == bidi.EN) || (end < len(t) && t[end] == bidi.EN) {
+			for j := i; j < end; j++ {
+				t[j] = bidi.EN
+			}
+		}
+
+		i = end
+	}
+
+	// W6 & W7: the remaining separators are neutrals, and european numbers in left to right text are left to right
+	last = e
+
+	for i, class := range t {
+		switch class {
+		case bidi.ES, bidi.ET, bidi.CS:
+			t[i] = bidi.ON
+		case bidi.L, bidi.R:
+			last = class
+		case bidi.EN:
+			if last == bidi.L {
+				t[i] = bidi.L
+			}
+		}
+	}
+
+	// N0: both brackets of a pair take the direction of the text inside them when it is the direction of the
+	// sequence. When the text inside only has the other direction, they take it if the text before them has it too
+	for _, pair := range s.bracketPairs() {
+		dir := bidi.ON
+
+		for i := pair[0] + 1; i < pair[1] && dir != e; i++ {
+			if class := strongClass(t[i]); class != bidi.ON {
+				dir = class
+			}
+		}
+
+		if dir == bidi.ON {
+			continue
+		} else if dir != e {
+			before := e
+
+			for i := pair[0] - 1; i >= 0; i-- {
+				if class := strongClass(t[i]); class != bidi.ON {
+					before = class
+					break
+				}
+			}
+
+			if before != dir {
+				dir = e
+			}
+		}
+
+		// nonspacing marks after a bracket follow it
+		for _, i := range pair {
+			t[i] = dir
+
+			for j := i + 1; j < len(t) && original[j] == bidi.NSM; j++ {
+				t[j] = dir
+			}
+		}
+	}
+
+	// N1 & N2: neutrals between text of the same direction take that direction, others the sequence direction
+	strong := func(i int) bidi.Class {
+		if i < 0 || i >= len(t) {
+			return e
+		} else if t[i] == bidi.L {
+			return bidi.L
+		}
+
+		// numbers count as right to left here
+		return bidi.R
+	}
+
+	for i := 0; i < len(t); {
+		if !neutral(t[i]) {
+			i++
+			continue
+		}
+
+		end := i + 1
+
+		for end < len(t) && neutral(t[end]) {
+			end++
+		}
+
+		dir := e
+
+		if before := strong(i - 1); before == strong(end) {
+			dir = before
+		}
+
+		for j := i; j < end; j++ {
+			t[j] = dir
+		}
+
+		i = end
+	}
+
+	// I1 & I2
+	for i, class := range t {
+		level := s.level
+
+		if level%2 == 0 {
+			if class == bidi.R {
+				level++
+			} else if class == bidi.EN || class == bidi.AN {
+				level += 2
+			}
+		} else if class == bidi.L || class == bidi.EN || class == bidi.AN {
+			level++
+		}
+
+		if s.cols[i] >= 0 {
+			levels[s.cols[i]] = level
+		}
+	}
+}
+
+// strongClass returns the direction a class counts as next to brackets, numbers being right to left.
+// Returns ON for neutrals
+func strongClass(class bidi.Class) bidi.Class {
+	switch class {
+	case bidi.L:
+		return bidi.L
+	case bidi.R, bidi.EN, bidi.AN:
+		return bidi.R
+	}
+
+	return bidi.ON
+}
+
+func neutral(class bidi.Class) bool {
+	switch class {
+	case bidi.B, bidi.S, bidi.WS, bidi.ON, bidi.PDI:
+		return true
+	}
+
+	return false
+}
+
+// cellClass returns the bidi class of the character in a cell. Directional formatting characters are treated as
+// neutrals, the direction attribute takes their place. Images are left to right so their cells stay in order
+func cellClass(c cell) bidi.Class {
+	if c.img != nil {
+		return bidi.L
+	}
+
+	props, _ := bidi.LookupRune(c.char)
+
+	switch class := props.Class(); class {
+	case bidi.L, bidi.R, bidi.AL, bidi.EN, bidi.ES, bidi.ET, bidi.AN, bidi.CS, bidi.NSM, bidi.WS, bidi.S:
+		return class
+	case bidi.B:
+		return bidi.S
+	default:
+		return bidi.ON
+	}
+}
+
+// strongRTL reports if a character makes the row it is in need reordering
+func strongRTL(char rune) bool {
+	// no character before hebrew is right to left
+	if char < 0x590 {
+		return false
+	}
+
+	props, _ := bidi.LookupRune(char)
+	class := props.Class()
+	return class == bidi.R || class == bidi.AL || class == bidi.AN
+}
+
+// mirror returns the counterpart of a bracket, which is drawn in its place in right to left text
+func mirror(char rune) rune {
+	if props, _ := bidi.LookupRune(char); props.IsBracket() {
+		for _, mirrored := range bidi.ReverseString(string(char)) {
+			return mirrored
+		}
+	}
+
+	return char
+}
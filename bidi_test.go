@@ -0,0 +1,106 @@
+package main
+
+import (
+	"testing"
+)
+
+// rowOf returns a row of cells showing text, each cell with the given attributes
+func rowOf(text string, attrs attributes) []cell {
+	var cells []cell
+
+	for _, char := range text {
+		c := emptyCell()
+		c.char = char
+		c.attrs = attrs
+		cells = append(cells, c)
+	}
+
+	return cells
+}
+
+// visualText returns the characters of a row in the order they are drawn in
+func visualText(cells []cell, layout *bidiLayout) string {
+	var text []rune
+
+	for col := range cells {
+		c := cells[col]
+
+		if layout != nil {
+			c = layout.cell(cells, col)
+		}
+
+		text = append(text, c.char)
+	}
+
+	return string(text)
+}
+
+func TestLayoutRow(t *testing.T) {
+	tests := []struct {
+		name   string
+		text   string
+		attrs  attributes
+		visual string
+	}{
+		{"left to right", "abc def", 0, "abc def"},
+		{"right to left word", "a אב c", 0, "a בא c"},
+		{"numbers in right to left text", "א 12 ב", 0, "ב 12 א"},
+		{"brackets around right to left text", "אב(ג)d", 0, "(ג)באd"},
+		{"brackets around left to right text", "א(b)", 0, "א(b)"},
+		{"unpaired bracket", "א(ב", 0, "ב)א"},
+		{"tab between right to left words", "א\tב", 0, "א\tב"},
+		{"row sent right to left", "ab ", attrRTL, " ab"},
+		{"right to left text sent left to right", "אב c", attrLTR, "בא c"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cells := rowOf(test.text, test.attrs)
+
+			if visual := visualText(cells, layoutRow(cells)); visual != test.visual {
+				t.Errorf("got %q, want %q", visual, test.visual)
+			}
+		})
+	}
+}
+
+func TestLayoutRowWide(t *testing.T) {
+	cells := rowOf("בא！！ג", 0)
+	cells[2].attrs |= attrWide
+	cells[3].attrs |= attrContinuation
+
+	// the wide character is neutral between right to left letters, both halves stay in their order
+	layout := layoutRow(cells)
+	want := []int{4, 2, 3, 1, 0}
+
+	for col, logical := range want {
+		if layout.visual[col] != logical {
+			t.Fatalf("got %v, want %v", layout.visual, want)
+		}
+	}
+}
+
+func TestLogicalCol(t *testing.T) {
+	cells := rowOf("abאב", 0)
+	r := &renderer{layouts: []*bidiLayout{nil, layoutRow(cells)}}
+
+	tests := []struct {
+		col, row int
+		want     int
+	}{
+		{0, 0, 0},
+		{3, 0, 3},
+		{0, 1, 0},
+		{2, 1, 3},
+		{3, 1, 2},
+		{4, 1, 4},
+		{-1, 1, -1},
+		{2, 2, 2},
+	}
+
+	for _, test := range tests {
+		if got := r.logicalCol(test.col, test.row); got != test.want {
+			t.Errorf("logicalCol(%d, %d) = %d, want %d", test.col, test.row, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+)
+
+// weights of the lines going from the center of a box drawing character to each side
+const (
+	lineNone = iota
+	lineLight
+	lineHeavy
+	lineDouble
+)
+
+// boxLines holds the weight of the left, right, up and down lines of each character from U+2500 to U+257F.
+// Dashed lines, rounded corners and diagonals are listed with the lines they are drawn from, or none
+const boxLines = "" +
+	"1100220000110022110022000011002211002200001100220101020101020202" +
+	"1001200110022002011002100120022010102010102020200111021101210112" +
+	"0122022102120222101120111021101210222021201220221101210112012201" +
+	"1102210212022202111021101210221011202120122022201111211112112211" +
+	"1121111211222121122121121212222122122122122222221100220000110022" +
+	"3300003303010103030330011003300303100130033030101030303003110133" +
+	"0333301110333033330111033303331011303330331111333333010110011010" +
+	"0110000000000000100000100100000120000020020000021200001221000021"
+
+// number of dashes in the dashed lines
+var boxDashes = map[rune]int{
+	0x2504: 3, 0x2505: 3, 0x2506: 3, 0x2507: 3,
+	0x2508: 4, 0x2509: 4, 0x250a: 4, 0x250b: 4,
+	0x254c: 2, 0x254d: 2, 0x254e: 2, 0x254f: 2,
+}
+
+// quadrants of the block elements from U+2596 to U+259F, as bits for upper left, upper right, lower left and lower right
+var blockQuadrants = [...]uint8{4, 8, 1, 1 | 4 | 8, 1 | 8, 1 | 2 | 4, 1 | 2 | 8, 2, 2 | 4, 2 | 4 | 8}
+
+// procedural reports if a character is drawn by boxGlyph instead of coming from the font
+func procedural(char rune) bool {
+	return (char >= 0x2500 && char <= 0x259f) || (char >= 0x2800 && char <= 0x28ff)
+}
+
+// boxGlyph draws box drawing characters, block elements and braille patterns so they fill the whole cell,
+// letting them connect seamlessly with their neighbors. Returns nil for other characters, which come from the font
+func boxGlyph(char rune, width, height int) *image.Alpha {
+	img := image.NewAlpha(image.Rect(0, 0, width, height))
+
+	switch {
+	case char >= 0x2500 && char <= 0x257f:
+		drawBoxLines(img, char)
+	case char >= 0x2580 && char <= 0x259f:
+		drawBlock(img, char)
+	case char >= 0x2800 && char <= 0x28ff:
+		drawBraille(img, char)
+	default:
+		return nil
+	}
+
+	return img
+}
+
+func fillRect(img *image.Alpha, r image.Rectangle, alpha uint8) {
+	draw.Draw(img, r, image.NewUniform(color.Alpha{A: alpha}), image.Point{}, draw.Src)
+}
+
+func drawBoxLines(img *image.Alpha, char rune) {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	cx, cy := w/2, h/2
+	light := lineThickness
+	heavy := 2 * light
+
+	code := boxLines[(char-0x2500)*4:]
+	left, right, up, down := int(code[0]-'0'), int(code[1]-'0'), int(code[2]-'0'), int(code[3]-'0')
+
+	switch {
+	case char >= 0x256d && char <= 0x2570:
+		drawArc(img, char, light)
+		return
+	case char >= 0x2571 && char <= 0x2573:
+		if char != 0x2572 {
+			drawDiagonal(img, float64(w), 0, 0, float64(h), light)
+		}
+
+		if char != 0x2571 {
+			drawDiagonal(img, 0, 0, float64(w), float64(h), light)
+		}
+
+		return
+	}
+
+	single := func(weight int) bool {
+		return weight == lineLight || weight == lineHeavy
+	}
+
+	thickness := func(weight int) int {
+		if weight == lineHeavy {
+			return heavy
+		}
+
+		return light
+	}
+
+	// joint returns the line the end of an arm has to reach to connect to the lines perpendicular to it,
+	// as its position and thickness. dir is -1 for arms from the left or top and 1 for arms from the right or bottom,
+	// near & far are the perpendicular lines on the same and the other side of the line for the lines of double arms
+	joint := func(center, dir, near, far, opposite int, double bool) (p, t int) {
+		switch {
+		case double && near == lineDouble:
+			return center + dir*light, light
+		case single(near) || single(far):
+			t = thickness(near)
+
+			if single(far) && thickness(far) > t {
+				t = thickness(far)
+			}
+
+			return center, t
+		case double && far == lineDouble:
+			return center - dir*light, light
+		case !double && opposite == lineNone && (near == lineDouble || far == lineDouble):
+			return center + dir*light, light
+		default:
+			return center, 0
+		}
+	}
+
+	// lines cover from p - t/2 to p - t/2 + t, arms end where the line they reach ends
+	horizontal := func(x0, x1, y, weight int) {
+		t := thickness(weight)
+		fillRect(img, image.Rect(x0, y-t/2, x1, y-t/2+t), 255)
+	}
+
+	vertical := func(x, y0, y1, weight int) {
+		t := thickness(weight)
+		fillRect(img, image.Rect(x-t/2, y0, x-t/2+t, y1), 255)
+	}
+
+	if left == lineDouble {
+		p, t := joint(cx, -1, up, down, right, true)
+		horizontal(0, p-t/2+t, cy-light, lineLight)
+		p, t = joint(cx, -1, down, up, right, true)
+		horizontal(0, p-t/2+t, cy+light, lineLight)
+	} else if left != lineNone {
+		p, t := joint(cx, -1, up, down, right, false)
+		horizontal(0, p-t/2+t, cy, left)
+	}
+
+	if right == lineDouble {
+		p, t := joint(cx, 1, up, down, left, true)
+		horizontal(p-t/2, w, cy-light, lineLight)
+		p, t = joint(cx, 1, down, up, left, true)
+		horizontal(p-t/2, w, cy+light, lineLight)
+	} else if right != lineNone {
+		p, t := joint(cx, 1, up, down, left, false)
+		horizontal(p-t/2, w, cy, right)
+	}
+
+	if up == lineDouble {
+		p, t := joint(cy, -1, left, right, down, true)
+		vertical(cx-light, 0, p-t/2+t, lineLight)
+		p, t = joint(cy, -1, right, left, down, true)
+		vertical(cx+light, 0, p-t/2+t, lineLight)
+	} else if up != lineNone {
+		p, t := joint(cy, -1, left, right, down, false)
+		vertical(cx, 0, p-t/2+t, up)
+	}
+
+	if down == lineDouble {
+		p, t := joint(cy, 1, left, right, up, true)
+		vertical(cx-light, p-t/2, h, lineLight)
+		p, t = joint(cy, 1, right, left, up, true)
+		vertical(cx+light, p-t/2, h, lineLight)
+	} else if down != lineNone {
+		p, t := joint(cy, 1, left, right, up, false)
+		vertical(cx, p-t/2, h, down)
+	}
+
+	if dashes, ok := boxDashes[char]; ok {
+		cutDashes(img, dashes, left != lineNone)
+	}
+}
+
+// cutDashes clears gaps into a straight line, splitting it into dashes that are evenly spread over cells
+func cutDashes(img *image.Alpha, dashes int, horizontal bool) {
+	length := img.Rect.Dy()
+
+	if horizontal {
+		length = img.Rect.Dx()
+	}
+
+	for i := 0; i < dashes; i++ {
+		end := (i + 1) * length / dashes
+		gap := image.Rect(end-(length/dashes+2)/3, 0, end, img.Rect.Dy())
+
+		if !horizontal {
+			gap = image.Rect(0, end-(length/dashes+2)/3, img.Rect.Dx(), end)
+		}
+
+		fillRect(img, gap, 0)
+	}
+}
+
+// drawArc draws the rounded corners, a quarter circle between the middle of two sides of the cell
+func drawArc(img *image.Alpha, char rune, thickness int) {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	cx, cy := float64(w/2)+float64(thickness%2)/2, float64(h/2)+float64(thickness%2)/2
+	radius := cx
+
+	if cy < radius {
+		radius = cy
+	}
+
+	// the center of the circle is in the corner the arc bends around, with straight lines from the arc to the sides
+	dx, dy := 1.0, 1.0
+
+	switch char {
+	case 0x256e:
+		dx = -1
+	case 0x256f:
+		dx, dy = -1, -1
+	case 0x2570:
+		dy = -1
+	}
+
+	centerX, centerY := cx+dx*radius, cy+dy*radius
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			px, py := float64(x)+0.5, float64(y)+0.5
+			var distance float64
+
+			switch {
+			case (px-centerX)*dx <= 0 && (py-centerY)*dy <= 0:
+				distance = math.Abs(math.Hypot(px-centerX, py-centerY) - radius)
+			case (px-centerX)*dx > 0 && (py-centerY)*dy <= 0:
+				distance = math.Abs(py - cy)
+			case (px-centerX)*dx <= 0 && (py-centerY)*dy > 0:
+				distance = math.Abs(px - cx)
+			default:
+				continue
+			}
+
+			setCoverage(img, x, y, float64(thickness)/2+0.5-distance)
+		}
+	}
+}
+
+// drawDiagonal draws an antialiased line from x0, y0 to x1, y1
+func drawDiagonal(img *image.Alpha, x0, y0, x1, y1 float64, thickness int) {
+	length := math.Hypot(x1-x0, y1-y0)
+
+	for y := 0; y < img.Rect.Dy(); y++ {
+		for x := 0; x < img.Rect.Dx(); x++ {
+			px, py := float64(x)+0.5, float64(y)+0.5
+			distance := math.Abs((x1-x0)*(y0-py)-(x0-px)*(y1-y0)) / length
+			setCoverage(img, x, y, float64(thickness)/2+0.5-distance)
+		}
+	}
+}
+
+// setCoverage raises the alpha of a pixel to coverage, which is clamped between 0 and 1
+func setCoverage(img *image.Alpha, x, y int, coverage float64) {
+	if coverage <= 0 {
+		return
+	}
+
+	if coverage > 1 {
+		coverage = 1
+	}
+
+	alpha := uint8(coverage * 255)
+
+	if alpha > img.AlphaAt(x, y).A {
+		img.SetAlpha(x, y, color.Alpha{A: alpha})
+	}
+}
+
+func drawBlock(img *image.Alpha, char rune) {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+
+	// eighths of the cell, rounded so neighboring cells line up
+	eighthsX := func(n int) int { return (w*n + 4) / 8 }
+	eighthsY := func(n int) int { return (h*n + 4) / 8 }
+
+	switch {
+	case char == 0x2580:
+		fillRect(img, image.Rect(0, 0, w, eighthsY(4)), 255)
+	case char >= 0x2581 && char <= 0x2588:
+		fillRect(img, image.Rect(0, h-eighthsY(int(char-0x2580)), w, h), 255)
+	case char >= 0x2589 && char <= 0x258f:
+		fillRect(img, image.Rect(0, 0, eighthsX(int(0x2590-char)), h), 255)
+	case char == 0x2590:
+		fillRect(img, image.Rect(eighthsX(4), 0, w, h), 255)
+	case char >= 0x2591 && char <= 0x2593:
+		fillRect(img, img.Rect, uint8(64*(char-0x2590)))
+	case char == 0x2594:
+		fillRect(img, image.Rect(0, 0, w, eighthsY(1)), 255)
+	case char == 0x2595:
+		fillRect(img, image.Rect(w-eighthsX(1), 0, w, h), 255)
+	default:
+		quadrants := blockQuadrants[char-0x2596]
+		mx, my := eighthsX(4), eighthsY(4)
+		rects := []image.Rectangle{
+			image.Rect(0, 0, mx, my), image.Rect(mx, 0, w, my),
+			image.Rect(0, my, mx, h), image.Rect(mx, my, w, h),
+		}
+
+		for i, r := range rects {
+			if quadrants&(1<<uint(i)) != 0 {
+				fillRect(img, r, 255)
+			}
+		}
+	}
+}
+
+// braille dots are numbered down the left column then down the right column, with dots 7 and 8 added at the bottom
+var brailleDots = [8]image.Point{{0, 0}, {0, 1}, {0, 2}, {1, 0}, {1, 1}, {1, 2}, {0, 3}, {1, 3}}
+
+// drawBraille draws the dots of a braille pattern, each centered in its part of a 2x4 grid over the cell
+func drawBraille(img *image.Alpha, char rune) {
+	w, h := float64(img.Rect.Dx()), float64(img.Rect.Dy())
+	radius := math.Min(w/2, h/4) * 0.3
+
+	for bit, dot := range brailleDots {
+		if (char-0x2800)&(1<<uint(bit)) == 0 {
+			continue
+		}
+
+		centerX, centerY := (float64(dot.X)+0.5)*w/2, (float64(dot.Y)+0.5)*h/4
+
+		for y := int(centerY - radius - 1); y <= int(centerY+radius+1); y++ {
+			for x := int(centerX - radius - 1); x <= int(centerX+radius+1); x++ {
+				if x < 0 || y < 0 || x >= img.Rect.Dx() || y >= img.Rect.Dy() {
+					continue
+				}
+
+				distance := math.Hypot(float64(x)+0.5-centerX, float64(y)+0.5-centerY)
+				setCoverage(img, x, y, radius+0.5-distance)
+			}
+		}
+	}
+}
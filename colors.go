@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"image/color"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/image/colornames"
+)
+
+// palette is the xterm 256 color palette: 16 ansi colors, a 6x6x6 color cube and 24 shades of gray.
+// The first 16 are taken from the theme when drawing
+var palette = func() [256]color.RGBA {
+	var p [256]color.RGBA
+
+	ansi := []uint32{
+		0x000000, 0xcd0000, 0x00cd00, 0xcdcd00, 0x0000ee, 0xcd00cd, 0x00cdcd, 0xe5e5e5,
+		0x7f7f7f, 0xff0000, 0x00ff00, 0xffff00, 0x5c5cff, 0xff00ff, 0x00ffff, 0xffffff,
+	}
+
+	for i, rgb := range ansi {
+		p[i] = color.RGBA{R: uint8(rgb >> 16), G: uint8(rgb >> 8), B: uint8(rgb), A: 255}
+	}
+
+	levels := []uint8{0, 95, 135, 175, 215, 255}
+
+	for i := 0; i < 216; i++ {
+		p[16+i] = color.RGBA{R: levels[i/36], G: levels[i/6%6], B: levels[i%6], A: 255}
+	}
+
+	for i := 0; i < 24; i++ {
+		gray := uint8(8 + i*10)
+		p[232+i] = color.RGBA{R: gray, G: gray, B: gray, A: 255}
+	}
+
+	return p
+}()
+
+// references into the theme, a cellColor index is either one of these or an index into the 256 color palette
+const (
+	colorFixed = -1 - iota
+	colorForeground
+	colorBackground
+	colorCursor
+	colorSelection
+)
+
+var themeColorNames = map[string]int{
+	"foreground": colorForeground,
+	"background": colorBackground,
+	"cursor":     colorCursor,
+	"selection":  colorSelection,
+}
+
+// cellColor is either a fixed color or a reference into the theme or palette.
+// References are resolved when rendering, so cells using them are recolored when the theme changes
+type cellColor struct {
+	index int
+	rgba  color.RGBA
+}
+
+func fixedColor(rgba color.RGBA) cellColor {
+	return cellColor{index: colorFixed, rgba: rgba}
+}
+
+func (c cellColor) resolve() color.RGBA {
+	switch {
+	case c.index == colorFixed:
+		return c.rgba
+	case c.index == colorForeground:
+		return currentTheme.foreground
+	case c.index == colorBackground:
+		return currentTheme.background
+	case c.index == colorCursor:
+		return currentTheme.cursor
+	case c.index == colorSelection:
+		return currentTheme.selection
+	case c.index < 16:
+		return currentTheme.ansi[c.index]
+	default:
+		return palette[c.index]
+	}
+}
+
+// requestColor is a color sent in a request, either as {"r": int, "g": int, "b": int, "a": int},
+// a "#rrggbb" or "#rrggbbaa" string, a css color name, the name of a theme color
+// or an index into the 256 color palette
+type requestColor cellColor
+
+func (c *requestColor) UnmarshalJSON(data []byte) error {
+	var index int
+
+	if err := json.Unmarshal(data, &index); err == nil {
+		if index < 0 || index >= len(palette) {
+			return errors.Errorf("color index %d is outside the palette", index)
+		}
+
+		*c = requestColor{index: index}
+		return nil
+	}
+
+	var str string
+
+	if err := json.Unmarshal(data, &str); err == nil {
+		if index, ok := themeColorNames[str]; ok {
+			*c = requestColor{index: index}
+			return nil
+		}
+
+		rgba, err := parseColor(str)
+
+		if err != nil {
+			return err
+		}
+
+		*c = requestColor(fixedColor(rgba))
+		return nil
+	}
+
+	var obj struct {
+		R uint8  `json:"r"`
+		G uint8  `json:"g"`
+		B uint8  `json:"b"`
+		A *uint8 `json:"a"`
+	}
+
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return errors.Errorf("invalid color %s", data)
+	}
+
+	rgba := color.RGBA{R: obj.R, G: obj.G, B: obj.B, A: 255}
+
+	if obj.A != nil {
+		rgba.A = *obj.A
+	}
+
+	*c = requestColor(fixedColor(rgba))
+	return nil
+}
+
+// parseColor parses a hex or css color name
+func parseColor(str string) (color.RGBA, error) {
+	if !strings.HasPrefix(str, "#") {
+		rgba, ok := colornames.Map[strings.ToLower(str)]
+
+		if !ok {
+			return color.RGBA{}, errors.Errorf("unknown color name %q", str)
+		}
+
+		return rgba, nil
+	}
+
+	bytes, err := hex.DecodeString(str[1:])
+
+	if err != nil || (len(bytes) != 3 && len(bytes) != 4) {
+		return color.RGBA{}, errors.Errorf("invalid hex color %q, should be #rrggbb or #rrggbbaa", str)
+	}
+
+	rgba := color.RGBA{R: bytes[0], G: bytes[1], B: bytes[2], A: 255}
+
+	if len(bytes) == 4 {
+		rgba.A = bytes[3]
+	}
+
+	return rgba, nil
+}
+
+// over blends the straight alpha color c over the opaque color below
+func over(c, below color.RGBA) color.RGBA {
+	a := int(c.A)
+
+	return color.RGBA{
+		R: uint8((int(c.R)*a + int(below.R)*(255-a)) / 255),
+		G: uint8((int(c.G)*a + int(below.G)*(255-a)) / 255),
+		B: uint8((int(c.B)*a + int(below.B)*(255-a)) / 255),
+		A: 255,
+	}
+}
+
+// mix returns the color halfway between a and b, used for dim text
+func mix(a, b color.RGBA) color.RGBA {
+	return color.RGBA{
+		R: uint8((int(a.R) + int(b.R)) / 2),
+		G: uint8((int(a.G) + int(b.G)) / 2),
+		B: uint8((int(a.B) + int(b.B)) / 2),
+		A: a.A,
+	}
+}
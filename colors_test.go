@@ -0,0 +1,128 @@
+package main
+
+import (
+	"image/color"
+	"testing"
+)
+
+func TestParseColor(t *testing.T) {
+	tests := []struct {
+		str  string
+		want color.RGBA
+		ok   bool
+	}{
+		{"#ff8000", color.RGBA{R: 255, G: 128, A: 255}, true},
+		{"#FF800080", color.RGBA{R: 255, G: 128, A: 128}, true},
+		{"#00000000", color.RGBA{}, true},
+		{"red", color.RGBA{R: 255, A: 255}, true},
+		{"DarkBlue", color.RGBA{B: 139, A: 255}, true},
+		{"#fff", color.RGBA{}, false},
+		{"#ff80001", color.RGBA{}, false},
+		{"#gg0000", color.RGBA{}, false},
+		{"#", color.RGBA{}, false},
+		{"", color.RGBA{}, false},
+		{"notacolor", color.RGBA{}, false},
+	}
+
+	for _, test := range tests {
+		got, err := parseColor(test.str)
+
+		if (err == nil) != test.ok {
+			t.Errorf("parseColor(%q) got error %v, want ok: %t", test.str, err, test.ok)
+		} else if got != test.want {
+			t.Errorf("parseColor(%q) = %v, want %v", test.str, got, test.want)
+		}
+	}
+}
+
+func TestOver(t *testing.T) {
+	below := color.RGBA{R: 200, G: 100, B: 0, A: 255}
+
+	tests := []struct {
+		c    color.RGBA
+		want color.RGBA
+	}{
+		{color.RGBA{R: 10, G: 20, B: 30, A: 255}, color.RGBA{R: 10, G: 20, B: 30, A: 255}},
+		{color.RGBA{R: 10, G: 20, B: 30, A: 0}, below},
+		{color.RGBA{R: 0, G: 200, B: 255, A: 51}, color.RGBA{R: 160, G: 120, B: 51, A: 255}},
+	}
+
+	for _, test := range tests {
+		if got := over(test.c, below); got != test.want {
+			t.Errorf("over(%v) = %v, want %v", test.c, got, test.want)
+		}
+	}
+}
+
+func TestRequestColor(t *testing.T) {
+	tests := []struct {
+		json  string
+		index int
+		rgba  color.RGBA
+		ok    bool
+	}{
+		{`"#102030"`, colorFixed, color.RGBA{R: 16, G: 32, B: 48, A: 255}, true},
+		{`{"r": 1, "g": 2, "b": 3}`, colorFixed, color.RGBA{R: 1, G: 2, B: 3, A: 255}, true},
+		{`{"r": 1, "g": 2, "b": 3, "a": 4}`, colorFixed, color.RGBA{R: 1, G: 2, B: 3, A: 4}, true},
+		{`"foreground"`, colorForeground, color.RGBA{}, true},
+		{`"selection"`, colorSelection, color.RGBA{}, true},
+		{`3`, 3, color.RGBA{}, true},
+		{`255`, 255, color.RGBA{}, true},
+		{`256`, 0, color.RGBA{}, false},
+		{`-1`, 0, color.RGBA{}, false},
+		{`"nope"`, 0, color.RGBA{}, false},
+		{`true`, 0, color.RGBA{}, false},
+	}
+
+	for _, test := range tests {
+		var c requestColor
+		err := c.UnmarshalJSON([]byte(test.json))
+
+		if (err == nil) != test.ok {
+			t.Errorf("%s got error %v, want ok: %t", test.json, err, test.ok)
+		} else if test.ok && (c.index != test.index || c.rgba != test.rgba) {
+			t.Errorf("%s = %+v, want index %d and %v", test.json, c, test.index, test.rgba)
+		}
+	}
+}
+
+func TestThemeReferences(t *testing.T) {
+	defer func(saved theme) { currentTheme = saved }(currentTheme)
+
+	red, blue := color.RGBA{R: 255, A: 255}, color.RGBA{B: 255, A: 255}
+	colors := []cellColor{{index: colorForeground}, {index: colorBackground}, {index: 1}, {index: 200}, fixedColor(blue)}
+
+	for _, th := range []theme{themes["default"], themes["solarizedDark"]} {
+		currentTheme = th
+		want := []color.RGBA{th.foreground, th.background, th.ansi[1], palette[200], blue}
+
+		for i, c := range colors {
+			if got := c.resolve(); got != want[i] {
+				t.Errorf("color %+v resolved to %v, want %v", c, got, want[i])
+			}
+		}
+	}
+
+	// colors of a theme are based on the current theme, and may only refer to the palette outside the ansi colors
+	currentTheme = themes["default"]
+	fixed, cube := requestColor(fixedColor(red)), requestColor{index: 16}
+	req := themeRequest{Foreground: &fixed, ANSI: []*requestColor{nil, &cube}}
+
+	if err := req.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	got := req.theme()
+
+	if got.foreground != red || got.ansi[1] != palette[16] || got.background != themes["default"].background {
+		t.Errorf("theme request made %+v", got)
+	}
+
+	for _, ref := range []requestColor{{index: colorBackground}, {index: 15}} {
+		ref := ref
+
+		if err := (themeRequest{Cursor: &ref}).validate(); err == nil {
+			t.Errorf("theme request with a color referring to %d was valid", ref.index)
+		}
+	}
+}
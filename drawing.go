@@ -2,108 +2,377 @@ package main
 
 import (
 	"image"
-	"image/color"
-	"image/draw"
 	"math"
+	"time"
 
-	"github.com/golang/freetype/truetype"
-
-	"golang.org/x/image/math/fixed"
+	"github.com/go-gl/glfw/v3.3/glfw"
+	"github.com/pkg/errors"
 
 	"golang.org/x/image/font"
+	"golang.org/x/image/font/sfnt"
+	"golang.org/x/image/math/fixed"
 )
 
 const (
-	styleNormal = "normal"
-	styleBold   = "bold"
+	styleNormal     = "normal"
+	styleBold       = "bold"
+	styleItalic     = "italic"
+	styleBoldItalic = "boldItalic"
+
+	blinkInterval = 500 * time.Millisecond
 )
 
 var (
 	fontNormal font.Face
 	fontBold   font.Face
 
-	styles = map[string]bool{
-		styleNormal: true,
-		styleBold:   true,
+	// the italic faces are nil when no italic font is loaded, glyphs are then slanted when rasterized
+	fontItalic     font.Face
+	fontBoldItalic font.Face
+
+	styles = map[string]attributes{
+		styleNormal:     0,
+		styleBold:       attrBold,
+		styleItalic:     attrItalic,
+		styleBoldItalic: attrBold | attrItalic,
+	}
+
+	underlines = map[string]attributes{
+		"none":   0,
+		"single": attrUnderline,
+		"double": attrDoubleUnderline,
+		"curly":  attrCurlyUnderline,
+	}
+
+	directions = map[string]attributes{
+		"auto": 0,
+		"ltr":  attrLTR,
+		"rtl":  attrRTL,
 	}
+
+	// blinkVisible is toggled every blinkInterval by the main loop
+	blinkVisible = true
+
+	// offsets from the top of a cell, set when loading fonts
+	baseline              int
+	underlinePosition     int
+	strikethroughPosition int
+	lineThickness         int
+
+	// requests are parsed on the stdin goroutine and applied to the grid on the main thread
+	drawRequests = make(chan drawRequest, 1024)
+
+	// redraw is signaled when the window needs to be drawn again without the grid changing
+	redraw = make(chan struct{}, 1)
 )
 
 type drawRequest interface {
-	draw(out *image.RGBA)
+	apply(g *grid)
 }
 
 type charDrawRequest struct {
-	char      rune
-	col       int
-	row       int
-	textColor color.RGBA
-	bg        color.Color
-	style     string
+	col  int
+	row  int
+	cell cell
+}
+
+func (req charDrawRequest) apply(g *grid) {
+	if req.cell.attrs&attrWide != 0 && req.col == g.cols-1 {
+		sendError(errors.Errorf("char request got wide char %q at the last column", req.cell.text()))
+		return
+	}
+
+	g.put(req.col, req.row, req.cell)
 }
 
-func (req charDrawRequest) draw(out *image.RGBA) {
-	// not actually needed? could draw directly to out
-	img := image.NewRGBA(rect(req.col, req.row))
-	draw.Draw(img, img.Bounds(), image.NewUniform(req.bg), image.Point{}, draw.Src)
+// textDrawRequest draws a string from col & row, one grapheme cluster per cell or two for wide characters.
+// At the right edge of the grid the text either continues on the next row or is clipped
+type textDrawRequest struct {
+	text     string
+	col      int
+	row      int
+	wrap     bool
+	template cell
+}
+
+func (req textDrawRequest) apply(g *grid) {
+	col, row := req.col, req.row
+	cells := 0
+
+	for rest := req.text; rest != ""; {
+		var cluster string
+		var width int
+		cluster, rest, width = firstCluster(rest)
+
+		if col+width > g.cols {
+			if !req.wrap {
+				break
+			}
+
+			col = 0
+			row++
+		}
+
+		if row >= g.rows {
+			break
+		}
 
-	fontFace := fontNormal
+		if col >= 0 && row >= 0 {
+			c := req.template
+			c.setCluster(cluster, width)
+			g.put(col, row, c)
+			cells += width
+		}
 
-	if req.style == styleBold {
-		fontFace = fontBold
+		col += width
 	}
 
-	drawer := font.Drawer{
-		Dst:  img,
-		Src:  image.NewUniform(req.textColor),
-		Face: fontFace,
+	sendResponse(textEvent{Event: "text", Cells: cells})
+}
+
+type fillRectDrawRequest struct {
+	rect image.Rectangle
+	cell cell
+}
+
+func (req fillRectDrawRequest) apply(g *grid) {
+	g.fill(req.rect, req.cell)
+}
+
+// copyRectDrawRequest copies the cells in rect to another place in the grid.
+// When moving, the cells left behind are cleared
+type copyRectDrawRequest struct {
+	rect image.Rectangle
+	to   image.Point
+	move bool
+}
+
+func (req copyRectDrawRequest) apply(g *grid) {
+	g.copyRect(req.rect, req.to)
+
+	if !req.move {
+		return
 	}
 
-	drawer.Dot = fixed.P(req.col*colWidth+1, (req.row+1)*rowHeight-3)
-	drawer.DrawString(string(req.char))
+	moved := req.rect.Add(req.to.Sub(req.rect.Min))
+	r := req.rect.Intersect(image.Rect(0, 0, g.cols, g.rows))
 
-	draw.Draw(out, img.Bounds(), img, img.Bounds().Min, draw.Src)
+	for row := r.Min.Y; row < r.Max.Y; row++ {
+		for col := r.Min.X; col < r.Max.X; col++ {
+			if !image.Pt(col, row).In(moved) {
+				g.set(col, row, emptyCell())
+			}
+		}
+	}
 }
 
-type imageDrawRequest struct {
-	img image.Image
-	col int
-	row int
+// scrollDrawRequest shifts the rows inside rect up by lines, or down if lines is negative.
+// The rows scrolled into view are set to fill
+type scrollDrawRequest struct {
+	rect  image.Rectangle
+	lines int
+	fill  cell
 }
 
-func (req imageDrawRequest) draw(out *image.RGBA) {
-	start := image.Point{X: req.col * colWidth, Y: req.row * rowHeight}
-	bounds := req.img.Bounds()
-	cols := int(math.Ceil(float64(bounds.Dx()) / float64(colWidth)))
-	rows := int(math.Ceil(float64(bounds.Dy()) / float64(rowHeight)))
+func (req scrollDrawRequest) apply(g *grid) {
+	r := req.rect.Intersect(image.Rect(0, 0, g.cols, g.rows))
+	lines := req.lines
 
-	rect := image.Rect(
-		start.X, start.Y,
-		start.X+cols*colWidth, start.Y+rows*rowHeight)
+	if lines >= r.Dy() || lines <= -r.Dy() {
+		g.fill(r, req.fill)
+		return
+	}
 
-	// should be black
-	draw.Draw(out, rect, image.White, image.Point{}, draw.Src)
-	draw.Draw(out, bounds.Add(start), req.img, image.Point{}, draw.Src)
+	if lines > 0 {
+		g.copyRect(image.Rect(r.Min.X, r.Min.Y+lines, r.Max.X, r.Max.Y), r.Min)
+		g.fill(image.Rect(r.Min.X, r.Max.Y-lines, r.Max.X, r.Max.Y), req.fill)
+	} else if lines < 0 {
+		g.copyRect(image.Rect(r.Min.X, r.Min.Y, r.Max.X, r.Max.Y+lines), image.Pt(r.Min.X, r.Min.Y-lines))
+		g.fill(image.Rect(r.Min.X, r.Min.Y, r.Max.X, r.Min.Y-lines), req.fill)
+	}
 }
 
 type clearDrawRequest struct{}
 
-func (clearDrawRequest) draw(out *image.RGBA) {
-	draw.Draw(out, out.Bounds(), image.Black, image.Point{}, draw.Src)
+func (clearDrawRequest) apply(g *grid) {
+	g.clear()
+}
+
+// titleDrawRequest is sent through the draw requests since the window can only be changed from the main thread
+type titleDrawRequest struct {
+	win   *glfw.Window
+	title string
+}
+
+func (req titleDrawRequest) apply(*grid) {
+	req.win.SetTitle(req.title)
+}
+
+type closeDrawRequest struct {
+	win *glfw.Window
+}
+
+func (req closeDrawRequest) apply(*grid) {
+	req.win.SetShouldClose(true)
+}
+
+// batchDrawRequest is applied as a whole, so all of it shows up in the same frame
+type batchDrawRequest []drawRequest
+
+func (batch batchDrawRequest) apply(g *grid) {
+	for _, req := range batch {
+		req.apply(g)
+	}
+}
+
+func requestRedraw() {
+	select {
+	case redraw <- struct{}{}:
+	default:
+	}
+}
+
+// fontFace returns the face to draw a character with the attributes in,
+// slant is true if there is no italic face and the glyph has to be slanted instead
+func fontFace(attrs attributes) (face font.Face, slant bool) {
+	switch attrs & attrFace {
+	case attrBold:
+		return fontBold, false
+	case attrItalic:
+		if fontItalic != nil {
+			return fontItalic, false
+		}
+
+		return fontNormal, true
+	case attrBold | attrItalic:
+		if fontBoldItalic != nil {
+			return fontBoldItalic, false
+		}
+
+		return fontBold, true
+	default:
+		return fontNormal, false
+	}
 }
 
 func rect(col, row int) image.Rectangle {
 	return image.Rect(col*colWidth, row*rowHeight, (col+1)*colWidth, (row+1)*rowHeight)
 }
 
-func loadFonts(size int) {
-	ttFontNormal, _ := truetype.Parse(fontBytes)
-	ttFontBold, _ := truetype.Parse(fontBoldBytes)
+// loadFonts creates the faces from the font files, falling back to the embedded fonts,
+// and sizes the cells after them
+func loadFonts(size float64, faces fontFiles, fallbackData [][]byte) error {
+	requested := faces
+
+	if faces[faceRegular] == nil {
+		faces[faceRegular] = fontBytes
+
+		if faces[faceBold] == nil {
+			faces[faceBold] = fontBoldBytes
+		}
+	}
+
+	if faces[faceBold] == nil {
+		faces[faceBold] = faces[faceRegular]
+	}
+
+	var loaded [faceCount]font.Face
+	var regular *sfnt.Font
+
+	for face, data := range faces {
+		if data == nil {
+			continue
+		}
+
+		parsed, loadedFace, err := newFace(data, size)
+
+		if err != nil {
+			return errors.WithMessagef(err, "could not load %s font", faceNames[face])
+		}
+
+		if face == faceRegular {
+			regular = parsed
+		}
+
+		loaded[face] = loadedFace
+	}
+
+	loadedFallbacks := make([]fallbackFace, len(fallbackData))
+
+	for i, data := range fallbackData {
+		parsed, face, err := newFace(data, size)
+
+		if err != nil {
+			return errors.WithMessagef(err, "could not load fallback font %d", i)
+		}
+
+		loadedFallbacks[i] = fallbackFace{font: parsed, face: face}
+	}
+
+	width, height := cellSize(loaded[faceRegular], size)
+
+	if _, ok := atlasSizeFor(width, height); !ok {
+		return errors.Errorf("font of size %g with line spacing %g has cells of %d x %d pixels, too large for the glyph atlas",
+			size, lineSpacing, width, height)
+	}
+
+	fontNormal = loaded[faceRegular]
+	fontBold = loaded[faceBold]
+	fontItalic = loaded[faceItalic]
+	fontBoldItalic = loaded[faceBoldItalic]
+	regularFont = regular
+	shapingFaces = loadShapingFaces(faces)
+
+	fallbackFiles = fallbackData
+	fallbacks = loadedFallbacks
+	resolvedRunes = make(map[rune]int)
+
+	fontSize = size
+	fontFaces = requested
+	fontGeneration++
+
+	layoutCells(fontNormal, size)
+	return nil
+}
+
+// cellSize returns the size of the cells for the metrics of the face, with the extra space from lineSpacing
+func cellSize(face font.Face, size float64) (width, height int) {
+	metrics := face.Metrics()
+	advance, ok := face.GlyphAdvance('M')
+
+	if !ok {
+		advance = fixed.I(int(math.Round(size / 2)))
+	}
+
+	ascent := float64(metrics.Ascent) / 64
+	descent := float64(metrics.Descent) / 64
+	return advance.Ceil(), int(math.Ceil((ascent + descent) * lineSpacing))
+}
+
+// layoutCells sizes the cells after the metrics of the face, with the extra space from lineSpacing
+// split above and below the line. Also places the baseline and the lines for underline & strikethrough
+func layoutCells(face font.Face, size float64) {
+	metrics := face.Metrics()
+	ascent := float64(metrics.Ascent) / 64
+	descent := float64(metrics.Descent) / 64
+	lineHeight := (ascent + descent) * lineSpacing
+
+	colWidth, rowHeight = cellSize(face, size)
+	baseline = int(math.Round((lineHeight-ascent-descent)/2 + ascent))
+
+	lineThickness = int(math.Round(size / 14))
+
+	if lineThickness < 1 {
+		lineThickness = 1
+	}
+
+	underlinePosition = baseline + int(math.Round(descent/3))
+
+	xHeight := float64(metrics.XHeight) / 64
 
-	options := &truetype.Options{
-		Size:              float64(size),
-		GlyphCacheEntries: 2048,
+	if xHeight <= 0 {
+		xHeight = ascent / 2
 	}
 
-	fontNormal = truetype.NewFace(ttFontNormal, options)
-	fontBold = truetype.NewFace(ttFontBold, options)
+	strikethroughPosition = baseline - int(math.Round(xHeight/2))
 }
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/png"
+	"strings"
+
+	"github.com/go-text/typesetting/di"
+	gotext "github.com/go-text/typesetting/font"
+	ot "github.com/go-text/typesetting/font/opentype"
+	"github.com/go-text/typesetting/language"
+	"github.com/go-text/typesetting/shaping"
+	"github.com/pkg/errors"
+	"golang.org/x/image/draw"
+	"golang.org/x/image/math/fixed"
+	"golang.org/x/image/vector"
+)
+
+// emojiFont draws emoji in color when set, from the -emoji-font flag or the font request.
+// Only touched from the main thread
+var emojiFont *colorFont
+
+const (
+	textPresentation  = '\ufe0e'
+	emojiPresentation = '\ufe0f'
+)
+
+// colorFont is a font with colored glyphs, either layers of outlines each filled with a color from the palette
+// (COLR version 0 & CPAL tables) or png bitmaps (CBDT & CBLC or sbix tables)
+type colorFont struct {
+	face    *gotext.Face
+	layers  map[gotext.GID][]colorLayer
+	palette []color.NRGBA
+}
+
+type colorLayer struct {
+	glyph gotext.GID
+	color int
+}
+
+// layers with this color are drawn in the text color, which colored glyphs do not use, so they are drawn black
+const textColorLayer = 0xffff
+
+func parseColorFont(data []byte) (*colorFont, error) {
+	loader, err := ot.NewLoader(bytes.NewReader(data))
+
+	if err != nil {
+		return nil, errors.WithMessage(err, "could not parse emoji font")
+	}
+
+	parsed, err := gotext.NewFont(loader)
+
+	if err != nil {
+		return nil, errors.WithMessage(err, "could not parse emoji font")
+	}
+
+	f := &colorFont{face: gotext.NewFace(parsed)}
+
+	colr, colrErr := loader.RawTable(ot.MustNewTag("COLR"))
+	cpal, cpalErr := loader.RawTable(ot.MustNewTag("CPAL"))
+
+	if colrErr == nil && cpalErr == nil {
+		f.layers, f.palette, err = parseColorLayers(colr, cpal)
+
+		if err != nil {
+			return nil, errors.WithMessage(err, "could not parse emoji font")
+		}
+	}
+
+	return f, nil
+}
+
+// parseColorLayers reads the base glyphs and their layers from a version 0 COLR table, and the first palette of CPAL
+func parseColorLayers(colr, cpal []byte) (map[gotext.GID][]colorLayer, []color.NRGBA, error) {
+	invalid := errors.New("invalid COLR or CPAL table")
+	be := binary.BigEndian
+
+	if len(colr) < 14 || len(cpal) < 14 {
+		return nil, nil, invalid
+	}
+
+	numBase, baseOffset := int(be.Uint16(colr[2:])), int(be.Uint32(colr[4:]))
+	layerOffset, numLayers := int(be.Uint32(colr[8:])), int(be.Uint16(colr[12:]))
+
+	if baseOffset+numBase*6 > len(colr) || layerOffset+numLayers*4 > len(colr) {
+		return nil, nil, invalid
+	}
+
+	numEntries := int(be.Uint16(cpal[2:]))
+	recordsOffset, firstRecord := int(be.Uint32(cpal[8:])), int(be.Uint16(cpal[12:]))
+
+	if recordsOffset+(firstRecord+numEntries)*4 > len(cpal) {
+		return nil, nil, invalid
+	}
+
+	palette := make([]color.NRGBA, numEntries)
+
+	for i := range palette {
+		bgra := cpal[recordsOffset+(firstRecord+i)*4:]
+		palette[i] = color.NRGBA{R: bgra[2], G: bgra[1], B: bgra[0], A: bgra[3]}
+	}
+
+	layers := make(map[gotext.GID][]colorLayer, numBase)
+
+	for i := 0; i < numBase; i++ {
+		record := colr[baseOffset+i*6:]
+		glyph, first, count := gotext.GID(be.Uint16(record)), int(be.Uint16(record[2:])), int(be.Uint16(record[4:]))
+
+		if first+count > numLayers {
+			return nil, nil, invalid
+		}
+
+		for j := first; j < first+count; j++ {
+			layer := colr[layerOffset+j*4:]
+			layers[glyph] = append(layers[glyph], colorLayer{glyph: gotext.GID(be.Uint16(layer)), color: int(be.Uint16(layer[2:]))})
+		}
+	}
+
+	return layers, palette, nil
+}
+
+// coloredCluster tells if a grapheme cluster is drawn with the emoji font: when the emoji variation selector asks for
+// it, or when it is a wide character none of the text fonts have, like most emoji. Characters like digits that
+// have an emoji form as well stay text otherwise
+func coloredCluster(char rune, combining string, wide bool) bool {
+	if strings.ContainsRune(combining, emojiPresentation) {
+		return true
+	} else if strings.ContainsRune(combining, textPresentation) || !wide {
+		return false
+	}
+
+	return resolveFallback(char) < 0 && !hasGlyph(regularFont, char)
+}
+
+// draw rasterizes the colored glyph of a grapheme cluster, scaled to fit a width x height box.
+// Returns nil if the font has no colored glyph for it
+func (f *colorFont) draw(text string, width, height int) *image.NRGBA {
+	glyph, ok := f.clusterGlyph([]rune(text))
+
+	if !ok {
+		return nil
+	}
+
+	if layers, ok := f.layers[glyph]; ok {
+		return f.drawLayers(glyph, layers, width, height)
+	}
+
+	f.face.SetPpem(uint16(height), uint16(height))
+	bitmap, ok := f.face.GlyphData(glyph).(gotext.GlyphBitmap)
+
+	if !ok || bitmap.Format != gotext.PNG {
+		return nil
+	}
+
+	src, err := png.Decode(bytes.NewReader(bitmap.Data))
+
+	if err != nil {
+		return nil
+	}
+
+	// keeps the aspect ratio, centered in the box
+	bounds := src.Bounds()
+	w, h := width, bounds.Dy()*width/bounds.Dx()
+
+	if h > height {
+		w, h = bounds.Dx()*height/bounds.Dy(), height
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	dst := image.Rect((width-w)/2, (height-h)/2, (width-w)/2+w, (height-h)/2+h)
+	draw.CatmullRom.Scale(img, dst, src, bounds, draw.Over, nil)
+
+	return img
+}
+
+// clusterGlyph returns the glyph of a grapheme cluster. Emoji sequences joined with zero width joiners or followed by
+// a variation selector are shaped, so the ligature the font has for the whole sequence is used. When it has none,
+// the glyph of the first emoji is used
+func (f *colorFont) clusterGlyph(text []rune) (gotext.GID, bool) {
+	if len(text) == 1 {
+		return f.face.NominalGlyph(text[0])
+	}
+
+	output := shaper.Shape(shaping.Input{
+		Text:      text,
+		RunStart:  0,
+		RunEnd:    len(text),
+		Direction: di.DirectionLTR,
+		Face:      f.face,
+		Size:      fixed.I(rowHeight),
+		Script:    language.Common,
+	})
+
+	if len(output.Glyphs) == 0 || output.Glyphs[0].GlyphID == 0 {
+		return f.face.NominalGlyph(text[0])
+	}
+
+	return output.Glyphs[0].GlyphID, true
+}
+
+func (f *colorFont) drawLayers(glyph gotext.GID, layers []colorLayer, width, height int) *image.NRGBA {
+	extents, _ := f.face.FontHExtents()
+	lineHeight := extents.Ascender - extents.Descender
+
+	if lineHeight <= 0 {
+		lineHeight = float32(f.face.Upem())
+	}
+
+	scale := float32(height) / lineHeight
+	advance := f.face.HorizontalAdvance(glyph)
+
+	if advance*scale > float32(width) {
+		scale = float32(width) / advance
+	}
+
+	originX := (float32(width) - advance*scale) / 2
+	originY := (float32(height) + (extents.Ascender+extents.Descender)*scale) / 2
+
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	z := vector.NewRasterizer(width, height)
+
+	for _, layer := range layers {
+		outline, ok := f.face.GlyphData(layer.glyph).(gotext.GlyphOutline)
+
+		if !ok {
+			continue
+		}
+
+		c := color.NRGBA{A: 255}
+
+		if layer.color != textColorLayer && layer.color < len(f.palette) {
+			c = f.palette[layer.color]
+		}
+
+		z.Reset(width, height)
+		drawOutline(z, outline, originX, originY, scale)
+		z.Draw(img, img.Rect, image.NewUniform(c), image.Point{})
+	}
+
+	return img
+}
@@ -10,6 +10,8 @@ import (
 var (
 	mouseCol = -1
 	mouseRow = -1
+
+	lastResizeEvent resizeEvent
 )
 
 func charCallback(win *glfw.Window, char rune) {
@@ -45,16 +47,20 @@ func keyCallback(win *glfw.Window, key glfw.Key, scanCode int, action glfw.Actio
 func mouseClickCallback(win *glfw.Window, button glfw.MouseButton, action glfw.Action, mods glfw.ModifierKey) {
 	if buttonText, ok := mouseLookup[button]; ok {
 		mouseX, mouseY := win.GetCursorPos()
+		col, row := int(mouseX)/colWidth, int(mouseY)/rowHeight
 		sendResponse(mouseClickEvent{
-			Event:  "mouseClick",
-			Button: buttonText,
-			State:  actionLookup[action],
-			Col:    int(mouseX) / colWidth,
-			Row:    int(mouseY) / rowHeight,
-			Ctrl:   mods&glfw.ModControl != 0,
-			Shift:  mods&glfw.ModShift != 0,
-			Alt:    mods&glfw.ModAlt != 0,
-			Super:  mods&glfw.ModSuper != 0,
+			Event:      "mouseClick",
+			Button:     buttonText,
+			State:      actionLookup[action],
+			Col:        col,
+			LogicalCol: screenRenderer.logicalCol(col, row),
+			Row:        row,
+			Ctrl:       mods&glfw.ModControl != 0,
+			Shift:      mods&glfw.ModShift != 0,
+			Alt:        mods&glfw.ModAlt != 0,
+			Super:      mods&glfw.ModSuper != 0,
+
+			paneLocation: location(col, row),
 		})
 	}
 }
@@ -69,25 +75,39 @@ func mouseMoveCallback(win *glfw.Window, x64, y64 float64) {
 		mouseCol = newMouseCol
 		mouseRow = newMouseRow
 		sendResponse(mouseMoveEvent{
-			Event: "mouseMove",
-			Col:   mouseCol,
-			Row:   mouseRow,
+			Event:      "mouseMove",
+			Col:        mouseCol,
+			LogicalCol: screenRenderer.logicalCol(mouseCol, mouseRow),
+			Row:        mouseRow,
+
+			paneLocation: location(mouseCol, mouseRow),
 		})
 	}
 }
 
+// sizeCallback is also called when the fonts change, since that changes the size of the cells
 func sizeCallback(win *glfw.Window, width int, height int) {
-	newCols := width / colWidth
-	newRows := height / rowHeight
+	requestRedraw()
+
+	event := resizeEvent{Event: "size", Cols: width / colWidth, Rows: height / rowHeight, ColWidth: colWidth, RowHeight: rowHeight}
 
-	if newCols == cols && newRows == rows {
+	if event == lastResizeEvent {
 		return
 	}
 
-	cols = newCols
-	rows = newRows
+	cols = event.Cols
+	rows = event.Rows
+	screen.resize(cols, rows)
 
-	sendResponse(resizeEvent{Event: "size", Rows: rows, Cols: cols, ColWidth: colWidth, RowHeight: rowHeight})
+	cellsResized := event.ColWidth != lastResizeEvent.ColWidth || event.RowHeight != lastResizeEvent.RowHeight
+	lastResizeEvent = event
+	sendResponse(event)
+
+	if cellsResized {
+		for _, p := range sortedPanes() {
+			p.sendSize()
+		}
+	}
 }
 
 func sendError(err error) {
@@ -98,6 +118,11 @@ func sendErrorStr(err string) {
 	sendResponse(errorEvent{Event: "error", Error: err})
 }
 
+// sendIndexedError reports an error for one of the requests inside a batch request
+func sendIndexedError(index int, err error) {
+	sendResponse(errorEvent{Event: "error", Error: err.Error(), Index: &index})
+}
+
 func sendResponse(response interface{}) {
 	bytes, err := json.Marshal(response)
 
@@ -124,21 +149,33 @@ type charEvent struct {
 }
 
 type mouseClickEvent struct {
-	Event  string `json:"event"`
-	Button string `json:"button"`
-	State  string `json:"state"`
-	Col    int    `json:"col"`
-	Row    int    `json:"row"`
-	Ctrl   bool   `json:"ctrl"`
-	Shift  bool   `json:"shift"`
-	Alt    bool   `json:"alt"`
-	Super  bool   `json:"super"`
+	Event      string `json:"event"`
+	Button     string `json:"button"`
+	State      string `json:"state"`
+	Col        int    `json:"col"`
+	Row        int    `json:"row"`
+	LogicalCol int    `json:"logicalCol"`
+	Ctrl       bool   `json:"ctrl"`
+	Shift      bool   `json:"shift"`
+	Alt        bool   `json:"alt"`
+	Super      bool   `json:"super"`
+	paneLocation
 }
 
 type mouseMoveEvent struct {
-	Event string `json:"event"`
-	Col   int    `json:"col"`
-	Row   int    `json:"row"`
+	Event      string `json:"event"`
+	Col        int    `json:"col"`
+	Row        int    `json:"row"`
+	LogicalCol int    `json:"logicalCol"`
+	paneLocation
+}
+
+// paneLocation tells which pane the mouse is over, with the col & row in the content of the pane.
+// The fields are left out when the mouse is not over a pane
+type paneLocation struct {
+	Pane    string `json:"pane,omitempty"`
+	PaneCol *int   `json:"paneCol,omitempty"`
+	PaneRow *int   `json:"paneRow,omitempty"`
 }
 
 type resizeEvent struct {
@@ -149,9 +186,58 @@ type resizeEvent struct {
 	RowHeight int    `json:"rowHeight"`
 }
 
+// paneSizeEvent is sent when a pane is created or resized, and when the size of the cells changes
+type paneSizeEvent struct {
+	Event     string `json:"event"`
+	Pane      string `json:"pane"`
+	Cols      int    `json:"cols"`
+	Rows      int    `json:"rows"`
+	ColWidth  int    `json:"colWidth"`
+	RowHeight int    `json:"rowHeight"`
+}
+
+// textEvent is the reply to a text request
+type textEvent struct {
+	Event string `json:"event"`
+	Cells int    `json:"cells"`
+}
+
+// animationEvent is sent when an animation played its last frame
+type animationEvent struct {
+	Event string `json:"event"`
+	ID    string `json:"id"`
+}
+
+// glyphInfoEvent is the reply to a glyphInfo request
+type glyphInfoEvent struct {
+	Event    string `json:"event"`
+	Char     string `json:"char"`
+	Font     string `json:"font"`
+	Fallback int    `json:"fallback"`
+	Found    bool   `json:"found"`
+}
+
+// metricsEvent is sent both as the reply to a stats request and periodically as a metrics event
+type metricsEvent struct {
+	Event    string        `json:"event"`
+	Frame    timingSummary `json:"frame"`
+	Requests timingSummary `json:"requests"`
+	Upload   timingSummary `json:"upload"`
+}
+
+// timingSummary holds percentiles of the latest samples in milliseconds
+type timingSummary struct {
+	Count int     `json:"count"`
+	P50   float64 `json:"p50"`
+	P90   float64 `json:"p90"`
+	P99   float64 `json:"p99"`
+	Max   float64 `json:"max"`
+}
+
 type errorEvent struct {
 	Event string `json:"event"`
 	Error string `json:"error"`
+	Index *int   `json:"index,omitempty"`
 }
 
 var actionLookup = map[glfw.Action]string{
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/font/sfnt"
+)
+
+// fallbackFace is a font used for runes missing from the main font
+type fallbackFace struct {
+	font *sfnt.Font
+	face font.Face
+}
+
+var (
+	// only touched from the main thread, set when loading fonts
+	regularFont   *sfnt.Font
+	fallbackFiles [][]byte
+	fallbacks     []fallbackFace
+
+	// resolvedRunes caches which fallback each rune is drawn with, -1 being the main font
+	resolvedRunes = make(map[rune]int)
+
+	glyphBuffer sfnt.Buffer
+)
+
+// newFace parses a truetype or opentype font and creates a face of the given size from it
+func newFace(data []byte, size float64) (*sfnt.Font, font.Face, error) {
+	parsed, err := opentype.Parse(data)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	face, err := opentype.NewFace(parsed, &opentype.FaceOptions{Size: size, DPI: 72, Hinting: font.HintingNone})
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return parsed, face, nil
+}
+
+func hasGlyph(f *sfnt.Font, char rune) bool {
+	index, err := f.GlyphIndex(&glyphBuffer, char)
+	return err == nil && index != 0
+}
+
+// resolveFallback returns the index of the first fallback with a glyph for the rune,
+// or -1 if the main font has it or no font has it
+func resolveFallback(char rune) int {
+	if index, ok := resolvedRunes[char]; ok {
+		return index
+	}
+
+	index := -1
+
+	if !hasGlyph(regularFont, char) {
+		for i, fallback := range fallbacks {
+			if hasGlyph(fallback.font, char) {
+				index = i
+				break
+			}
+		}
+	}
+
+	resolvedRunes[char] = index
+	return index
+}
+
+// glyphFace returns the face to draw a rune with, going through the fallbacks if the main font is missing it.
+// Fallbacks only have a regular face, so bold & italic are lost when falling back
+func glyphFace(char rune, attrs attributes) (face font.Face, slant bool) {
+	if index := resolveFallback(char); index >= 0 {
+		return fallbacks[index].face, false
+	}
+
+	return fontFace(attrs)
+}
+
+// glyphInfoDrawRequest reports which font a rune is drawn with
+type glyphInfoDrawRequest struct {
+	char rune
+}
+
+func (req glyphInfoDrawRequest) apply(*grid) {
+	event := glyphInfoEvent{Event: "glyphInfo", Char: string(req.char), Fallback: resolveFallback(req.char)}
+	f := regularFont
+
+	if event.Fallback >= 0 {
+		f = fallbacks[event.Fallback].font
+	}
+
+	event.Found = hasGlyph(f, req.char)
+	event.Font, _ = f.Name(nil, sfnt.NameIDFamily)
+
+	sendResponse(event)
+}
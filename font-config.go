@@ -0,0 +1,329 @@
+package main
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-gl/glfw/v3.3/glfw"
+	"github.com/pkg/errors"
+	"golang.org/x/image/font/sfnt"
+)
+
+const (
+	faceRegular = iota
+	faceBold
+	faceItalic
+	faceBoldItalic
+	faceCount
+)
+
+var faceNames = [faceCount]string{"regular", "bold", "italic", "boldItalic"}
+
+// fontFiles holds the truetype or opentype data of each face, nil means using the fallback for that face
+type fontFiles [faceCount][]byte
+
+var (
+	// the current font, only touched from the main thread
+	fontSize  = 18.0
+	fontFaces fontFiles
+
+	// lineSpacing scales the height of the rows, 1 is the line height of the font
+	lineSpacing = 1.0
+
+	// fontGeneration is bumped every time the fonts are loaded, so glyphs drawn with the old fonts can be thrown away
+	fontGeneration int
+)
+
+// fontSource is a font file sent either as a path or as base64 encoded data
+type fontSource struct {
+	Path *string `json:"path"`
+	Data *string `json:"data"`
+}
+
+// load returns the content of the font file without checking it
+func (src fontSource) load() ([]byte, error) {
+	var data []byte
+	var err error
+
+	if src.Path != nil {
+		data, err = ioutil.ReadFile(*src.Path)
+	} else if src.Data != nil {
+		data, err = base64.StdEncoding.DecodeString(*src.Data)
+	} else {
+		return nil, errors.New("font is missing \"path\" or \"data\" field")
+	}
+
+	if err != nil {
+		return nil, errors.WithMessage(err, "could not read font")
+	}
+
+	return data, nil
+}
+
+func (src fontSource) read() ([]byte, error) {
+	data, err := src.load()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := sfnt.Parse(data); err != nil {
+		return nil, errors.WithMessage(err, "could not parse font")
+	}
+
+	return data, nil
+}
+
+// fontRequest is sent to change the font. Faces that are not sent keep their current font,
+// except when a family is sent, then all faces come from that family
+type fontRequest struct {
+	Size        *float64    `json:"size"`
+	LineSpacing *float64    `json:"lineSpacing"`
+	Family      *string     `json:"family"`
+	Regular     *fontSource `json:"regular"`
+	Bold        *fontSource `json:"bold"`
+	Italic      *fontSource `json:"italic"`
+	BoldItalic  *fontSource `json:"boldItalic"`
+
+	// Fallback replaces the fonts used, in order, for characters missing from the main font
+	Fallback []fontSource `json:"fallback"`
+
+	// Emoji is a font with COLR or CBDT color glyphs, used for the characters it has color glyphs for
+	Emoji *fontSource `json:"emoji"`
+
+	// Shaping turns shaping of text runs on or off, for ligatures and complex scripts
+	Shaping *bool `json:"shaping"`
+}
+
+func (req fontRequest) drawRequest(win *glfw.Window) (drawRequest, error) {
+	fontReq := fontDrawRequest{win: win, shaping: req.Shaping}
+
+	if req.Size != nil {
+		if *req.Size < 4 || *req.Size > 400 {
+			return nil, errors.Errorf("font request got invalid size %v, should be between 4 and 400", *req.Size)
+		}
+
+		fontReq.size = *req.Size
+	}
+
+	if req.LineSpacing != nil {
+		if *req.LineSpacing < 0.5 || *req.LineSpacing > 4 {
+			return nil, errors.Errorf("font request got invalid line spacing %v, should be between 0.5 and 4", *req.LineSpacing)
+		}
+
+		fontReq.lineSpacing = *req.LineSpacing
+	}
+
+	if req.Family != nil {
+		faces, err := findFamily(*req.Family)
+
+		if err != nil {
+			return nil, err
+		}
+
+		fontReq.faces = faces
+		fontReq.set = [faceCount]bool{true, true, true, true}
+	}
+
+	for face, src := range [faceCount]*fontSource{req.Regular, req.Bold, req.Italic, req.BoldItalic} {
+		if src == nil {
+			continue
+		}
+
+		data, err := src.read()
+
+		if err != nil {
+			return nil, errors.WithMessagef(err, "font request %s face", faceNames[face])
+		}
+
+		fontReq.faces[face] = data
+		fontReq.set[face] = true
+	}
+
+	if req.Fallback != nil {
+		fontReq.fallback = [][]byte{}
+
+		for i, src := range req.Fallback {
+			data, err := src.read()
+
+			if err != nil {
+				return nil, errors.WithMessagef(err, "font request fallback %d", i)
+			}
+
+			fontReq.fallback = append(fontReq.fallback, data)
+		}
+	}
+
+	if req.Emoji != nil {
+		data, err := req.Emoji.load()
+
+		if err != nil {
+			return nil, errors.WithMessage(err, "font request emoji")
+		}
+
+		fontReq.emoji, err = parseColorFont(data)
+
+		if err != nil {
+			return nil, errors.WithMessage(err, "font request emoji")
+		}
+	}
+
+	return fontReq, nil
+}
+
+// fontDrawRequest loads new fonts, which changes the size of the cells and so the number of cols & rows
+type fontDrawRequest struct {
+	win         *glfw.Window
+	size        float64
+	lineSpacing float64
+	faces       fontFiles
+	set         [faceCount]bool
+
+	// fallback is nil when the fallbacks are kept
+	fallback [][]byte
+
+	// emoji is nil when the emoji font is kept
+	emoji *colorFont
+
+	shaping *bool
+}
+
+func (req fontDrawRequest) apply(*grid) {
+	size := fontSize
+	faces := fontFaces
+
+	if req.size != 0 {
+		size = req.size
+	}
+
+	for face := range faces {
+		if req.set[face] {
+			faces[face] = req.faces[face]
+		}
+	}
+
+	previousSpacing := lineSpacing
+
+	if req.lineSpacing != 0 {
+		lineSpacing = req.lineSpacing
+	}
+
+	fallback := fallbackFiles
+
+	if req.fallback != nil {
+		fallback = req.fallback
+	}
+
+	err := loadFonts(size, faces, fallback)
+
+	if err != nil {
+		lineSpacing = previousSpacing
+		sendError(err)
+		return
+	}
+
+	if req.emoji != nil {
+		emojiFont = req.emoji
+	}
+
+	if req.shaping != nil {
+		shapingEnabled = *req.shaping
+	}
+
+	for _, g := range grids() {
+		g.markAllDirty()
+	}
+
+	width, height := req.win.GetSize()
+	sizeCallback(req.win, width, height)
+}
+
+// findFamily looks through the font directories of the system for the faces of a font family.
+// "default" is the embedded DejaVu Sans Mono
+func findFamily(family string) (fontFiles, error) {
+	var faces fontFiles
+
+	if family == "default" {
+		return faces, nil
+	}
+
+	for _, dir := range fontDirs() {
+		_ = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			ext := strings.ToLower(filepath.Ext(path))
+
+			if err != nil || info.IsDir() || (ext != ".ttf" && ext != ".otf") {
+				return nil
+			}
+
+			data, err := ioutil.ReadFile(path)
+
+			if err != nil {
+				return nil
+			}
+
+			f, err := sfnt.Parse(data)
+
+			if err != nil {
+				return nil
+			}
+
+			name, _ := f.Name(nil, sfnt.NameIDFamily)
+
+			if !strings.EqualFold(name, family) {
+				return nil
+			}
+
+			subfamily, _ := f.Name(nil, sfnt.NameIDSubfamily)
+			subfamily = strings.ToLower(subfamily)
+			bold := strings.Contains(subfamily, "bold")
+			italic := strings.Contains(subfamily, "italic") || strings.Contains(subfamily, "oblique")
+
+			face := faceRegular
+
+			if bold && italic {
+				face = faceBoldItalic
+			} else if bold {
+				face = faceBold
+			} else if italic {
+				face = faceItalic
+			} else if subfamily != "regular" && subfamily != "book" && subfamily != "normal" && subfamily != "roman" {
+				return nil
+			}
+
+			if faces[face] == nil {
+				faces[face] = data
+			}
+
+			return nil
+		})
+	}
+
+	if faces[faceRegular] == nil {
+		return faces, errors.Errorf("could not find font family %q", family)
+	}
+
+	return faces, nil
+}
+
+func fontDirs() []string {
+	home, _ := os.UserHomeDir()
+
+	dirs := []string{
+		"/usr/share/fonts",
+		"/usr/local/share/fonts",
+		filepath.Join(home, ".fonts"),
+		filepath.Join(home, ".local", "share", "fonts"),
+		"/Library/Fonts",
+		"/System/Library/Fonts",
+		filepath.Join(home, "Library", "Fonts"),
+	}
+
+	if windir := os.Getenv("WINDIR"); windir != "" {
+		dirs = append(dirs, filepath.Join(windir, "Fonts"))
+	}
+
+	return dirs
+}
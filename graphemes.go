@@ -0,0 +1,40 @@
+package main
+
+import (
+	"github.com/rivo/uniseg"
+)
+
+// firstCluster splits the first grapheme cluster, a character together with its combining marks,
+// off str and returns the number of cells it covers, 2 for east asian wide characters and 1 otherwise
+func firstCluster(str string) (cluster, rest string, width int) {
+	cluster, rest, width, _ = uniseg.FirstGraphemeClusterInString(str, -1)
+
+	if width < 1 {
+		width = 1
+	} else if width > 2 {
+		width = 2
+	}
+
+	return cluster, rest, width
+}
+
+// setCluster puts a grapheme cluster of the given width in the cell
+func (c *cell) setCluster(cluster string, width int) {
+	c.char = ' '
+	c.combining = ""
+
+	for i, char := range cluster {
+		if i == 0 {
+			c.char = char
+		} else {
+			c.combining = cluster[i:]
+			break
+		}
+	}
+
+	c.attrs &^= attrWidth
+
+	if width == 2 {
+		c.attrs |= attrWide
+	}
+}
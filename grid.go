@@ -0,0 +1,387 @@
+package main
+
+import (
+	"image"
+)
+
+// screen is the grid shown in the window. It is only touched from the main thread.
+var screen = newGrid(0, 0)
+
+// attributes are the flags changing how the character in a cell is drawn
+type attributes uint16
+
+const (
+	attrBold attributes = 1 << iota
+	attrItalic
+	attrUnderline
+	attrDoubleUnderline
+	attrCurlyUnderline
+	attrStrikethrough
+	attrDim
+	attrReverse
+	attrBlink
+
+	// a wide character covers two cells, the left one is marked attrWide and the right one attrContinuation.
+	// Both hold the character, each drawing its half of the glyph
+	attrWide
+	attrContinuation
+
+	// the direction of the run the cell was drawn in, neither means auto
+	attrLTR
+	attrRTL
+
+	// attributes that pick the font face, the rest are applied when rendering
+	attrFace       = attrBold | attrItalic
+	attrUnderlines = attrUnderline | attrDoubleUnderline | attrCurlyUnderline
+	attrWidth      = attrWide | attrContinuation
+	attrDirection  = attrLTR | attrRTL
+)
+
+// cell is a single box in the grid, showing either a character or a fragment of an image
+type cell struct {
+	char rune
+
+	// combining holds the runes following char when the character is a grapheme cluster,
+	// like a letter with combining accents or an emoji sequence
+	combining string
+
+	textColor cellColor
+	bg        cellColor
+	attrs     attributes
+
+	// underlineColor is used for underlines if set, otherwise they get the text color
+	underlineColor *cellColor
+
+	// img is set when the cell shows a part of an image, imgOffset is then the column & row of that part in cells
+	// from the top left corner of the image bounds. The character and the background, if translucent, are drawn
+	// over the image unless imgAbove is set. imgID is the id of the uploaded image, empty for images sent with the image request
+	img       image.Image
+	imgOffset image.Point
+	imgID     string
+	imgAbove  bool
+}
+
+func emptyCell() cell {
+	return cell{char: ' ', textColor: cellColor{index: colorForeground}, bg: cellColor{index: colorBackground}}
+}
+
+// text returns the whole grapheme cluster in the cell
+func (c cell) text() string {
+	return string(c.char) + c.combining
+}
+
+// equal reports if two cells look the same
+func (c cell) equal(other cell) bool {
+	if c.underlineColor != nil && other.underlineColor != nil && *c.underlineColor == *other.underlineColor {
+		c.underlineColor, other.underlineColor = nil, nil
+	}
+
+	return c == other
+}
+
+// continuation returns the right half of a wide cell
+func (c cell) continuation() cell {
+	c.attrs = c.attrs&^attrWide | attrContinuation
+	return c
+}
+
+// span is a range of columns in a row, from inclusive and to exclusive
+type span struct {
+	from int
+	to   int
+}
+
+func (s span) empty() bool {
+	return s.from >= s.to
+}
+
+// maxGridCells is the most cells a layer or pane sent in a request can have
+const maxGridCells = 1 << 20
+
+// validGridSize tells if a grid of cols x rows has at least one cell and at most maxGridCells
+func validGridSize(cols, rows int) bool {
+	return cols > 0 && rows > 0 && cols <= maxGridCells/rows
+}
+
+type grid struct {
+	cols  int
+	rows  int
+	cells []cell
+
+	// damage since the renderer last looked at the grid, kept as a span of dirty columns per row.
+	// allDirty is set when the layout of the grid changed, imagesDirty when cells showing images changed
+	dirty       []span
+	allDirty    bool
+	imagesDirty bool
+
+	// number of cells with the blink attribute, the main loop only has to wake up for blinking when there are any
+	blinking int
+
+	// number of cells showing each animation, only the animations shown on visible grids are played
+	animations map[*animation]int
+}
+
+func newGrid(cols, rows int) *grid {
+	g := &grid{cols: cols, rows: rows, cells: make([]cell, cols*rows), dirty: make([]span, rows)}
+	g.clear()
+	return g
+}
+
+// at returns the cell at col & row, ok is false if it is outside the grid
+func (g *grid) at(col, row int) (c cell, ok bool) {
+	if col < 0 || row < 0 || col >= g.cols || row >= g.rows {
+		return cell{}, false
+	}
+
+	return g.cells[row*g.cols+col], true
+}
+
+// set changes the cell at col & row, cells outside the grid are ignored
+func (g *grid) set(col, row int, c cell) {
+	if col < 0 || row < 0 || col >= g.cols || row >= g.rows {
+		return
+	}
+
+	old := &g.cells[row*g.cols+col]
+
+	// clients sending the same content again don't cause any work
+	if old.equal(c) {
+		return
+	}
+
+	g.breakWide(col, row, *old)
+
+	if old.img != nil || c.img != nil {
+		g.imagesDirty = true
+	}
+
+	if old.attrs&attrBlink != 0 {
+		g.blinking--
+	}
+
+	if c.attrs&attrBlink != 0 {
+		g.blinking++
+	}
+
+	g.countAnimation(*old, -1)
+	g.countAnimation(c, 1)
+
+	*old = c
+	g.markDirty(image.Rect(col, row, col+1, row+1))
+}
+
+// put sets the cell like set, except that a translucent background is blended over what is already in the cell.
+// If that is an image, it is kept and the cell is drawn on top of it. A wide character is not put in the last column,
+// where its right half would be outside the grid
+func (g *grid) put(col, row int, c cell) {
+	old, ok := g.at(col, row)
+
+	if !ok || c.attrs&attrWide != 0 && col == g.cols-1 {
+		return
+	}
+
+	if c.bg.index == colorFixed && c.bg.rgba.A < 255 && c.img == nil {
+		if old.img != nil {
+			c.img = old.img
+			c.imgOffset = old.imgOffset
+			c.imgID = old.imgID
+			c.imgAbove = old.imgAbove
+		} else {
+			c.bg = fixedColor(over(c.bg.rgba, old.bg.resolve()))
+		}
+	}
+
+	g.set(col, row, c)
+
+	if c.attrs&attrWide != 0 {
+		g.put(col+1, row, c.continuation())
+	}
+}
+
+// breakWide blanks the other half of a wide character when one half, old, is about to be overwritten
+func (g *grid) breakWide(col, row int, old cell) {
+	other, half := col+1, attrContinuation
+
+	if old.attrs&attrContinuation != 0 {
+		other, half = col-1, attrWide
+	} else if old.attrs&attrWide == 0 {
+		return
+	}
+
+	if other < 0 || other >= g.cols {
+		return
+	}
+
+	c := &g.cells[row*g.cols+other]
+
+	if c.attrs&half == 0 || c.char != old.char || c.combining != old.combining {
+		return
+	}
+
+	c.char = ' '
+	c.combining = ""
+	c.attrs &^= attrWidth
+	g.markDirty(image.Rect(other, row, other+1, row+1))
+}
+
+// fill puts c in every cell inside r, which is in cols & rows. Wide characters are put in every other column
+func (g *grid) fill(r image.Rectangle, c cell) {
+	r = r.Intersect(image.Rect(0, 0, g.cols, g.rows))
+	step := 1
+
+	if c.attrs&attrWide != 0 {
+		step = 2
+	}
+
+	for row := r.Min.Y; row < r.Max.Y; row++ {
+		for col := r.Min.X; col+step <= r.Max.X; col += step {
+			g.put(col, row, c)
+		}
+	}
+}
+
+// copyRect copies the cells inside src so its top left corner ends up at dst, the areas are allowed to overlap.
+// Cells outside the grid are treated as empty
+func (g *grid) copyRect(src image.Rectangle, dst image.Point) {
+	src = src.Canon()
+
+	// only the cells ending up inside the grid are copied
+	to := image.Rectangle{Min: dst, Max: dst.Add(src.Size())}.Intersect(image.Rect(0, 0, g.cols, g.rows))
+	from := to.Min.Sub(dst).Add(src.Min)
+	copied := make([]cell, 0, to.Dx()*to.Dy())
+
+	for row := 0; row < to.Dy(); row++ {
+		for col := 0; col < to.Dx(); col++ {
+			c, ok := g.at(from.X+col, from.Y+row)
+
+			if !ok {
+				c = emptyCell()
+			}
+
+			copied = append(copied, c)
+		}
+	}
+
+	for i, c := range copied {
+		g.set(to.Min.X+i%to.Dx(), to.Min.Y+i/to.Dx(), c)
+	}
+}
+
+func (g *grid) clear() {
+	for i := range g.cells {
+		g.cells[i] = emptyCell()
+	}
+
+	g.blinking = 0
+	g.animations = make(map[*animation]int)
+	g.markAllDirty()
+}
+
+// resize changes the size of the grid, keeping the content that still fits
+func (g *grid) resize(cols, rows int) {
+	if cols == g.cols && rows == g.rows {
+		return
+	}
+
+	resized := newGrid(cols, rows)
+
+	for row := 0; row < rows && row < g.rows; row++ {
+		copy(resized.cells[row*cols:(row+1)*cols], g.cells[row*g.cols:(row+1)*g.cols])
+
+		// a wide character whose right half was cut off is blanked, like when its right half is overwritten
+		if last := &resized.cells[(row+1)*cols-1]; cols < g.cols && last.attrs&attrWide != 0 {
+			last.char = ' '
+			last.combining = ""
+			last.attrs &^= attrWidth
+		}
+	}
+
+	for _, c := range resized.cells {
+		if c.attrs&attrBlink != 0 {
+			resized.blinking++
+		}
+
+		resized.countAnimation(c, 1)
+	}
+
+	*g = *resized
+}
+
+// countAnimation adds delta to the number of cells showing the animation of c, if it shows one
+func (g *grid) countAnimation(c cell, delta int) {
+	placed, ok := c.img.(*animatedPlacement)
+
+	if !ok {
+		return
+	}
+
+	g.animations[placed.anim] += delta
+
+	if g.animations[placed.anim] <= 0 {
+		delete(g.animations, placed.anim)
+	}
+}
+
+// markDirty marks a rectangle of cells as changed, r is in cols & rows
+func (g *grid) markDirty(r image.Rectangle) {
+	r = r.Intersect(image.Rect(0, 0, g.cols, g.rows))
+
+	for row := r.Min.Y; row < r.Max.Y; row++ {
+		dirty := &g.dirty[row]
+
+		if dirty.empty() {
+			*dirty = span{from: r.Min.X, to: r.Max.X}
+			continue
+		}
+
+		if r.Min.X < dirty.from {
+			dirty.from = r.Min.X
+		}
+
+		if r.Max.X > dirty.to {
+			dirty.to = r.Max.X
+		}
+	}
+}
+
+func (g *grid) markAllDirty() {
+	g.allDirty = true
+	g.imagesDirty = true
+	g.markDirty(image.Rect(0, 0, g.cols, g.rows))
+}
+
+// markBlinkingDirty marks all blinking cells as changed, used each time they blink on or off
+func (g *grid) markBlinkingDirty() {
+	if g.blinking == 0 {
+		return
+	}
+
+	for i, c := range g.cells {
+		if c.attrs&attrBlink != 0 {
+			g.markDirty(image.Rect(i%g.cols, i/g.cols, i%g.cols+1, i/g.cols+1))
+		}
+	}
+}
+
+func (g *grid) damaged() bool {
+	if g.allDirty || g.imagesDirty {
+		return true
+	}
+
+	for _, dirty := range g.dirty {
+		if !dirty.empty() {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (g *grid) resetDamage() {
+	for i := range g.dirty {
+		g.dirty[i] = span{}
+	}
+
+	g.allDirty = false
+	g.imagesDirty = false
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"image"
+	"testing"
+)
+
+// gridOf returns a grid with a row for each string, all of the same length
+func gridOf(rows ...string) *grid {
+	g := newGrid(len([]rune(rows[0])), len(rows))
+
+	for row, text := range rows {
+		for col, char := range []rune(text) {
+			g.cells[row*g.cols+col].char = char
+		}
+	}
+
+	return g
+}
+
+// rowsOf returns the characters in each row of a grid
+func rowsOf(g *grid) []string {
+	rows := make([]string, g.rows)
+
+	for row := range rows {
+		text := make([]rune, g.cols)
+
+		for col := range text {
+			text[col] = g.cells[row*g.cols+col].char
+		}
+
+		rows[row] = string(text)
+	}
+
+	return rows
+}
+
+func equalRows(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func TestResize(t *testing.T) {
+	tests := []struct {
+		name       string
+		cols, rows int
+		want       []string
+	}{
+		{"same size", 3, 2, []string{"abc", "def"}},
+		{"larger", 4, 3, []string{"abc ", "def ", "    "}},
+		{"fewer cols", 2, 2, []string{"ab", "de"}},
+		{"fewer rows", 3, 1, []string{"abc"}},
+		{"empty", 0, 0, []string{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			g := gridOf("abc", "def")
+			g.resize(test.cols, test.rows)
+
+			if g.cols != test.cols || g.rows != test.rows || len(g.cells) != test.cols*test.rows {
+				t.Fatalf("got %d x %d grid with %d cells", g.cols, g.rows, len(g.cells))
+			} else if got := rowsOf(g); !equalRows(got, test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSet(t *testing.T) {
+	type point struct{ col, row int }
+
+	tests := []struct {
+		name  string
+		start string
+		set   []point
+		want  []string
+		dirty []span
+	}{
+		{"one cell", "abc", []point{{1, 1}}, []string{"abc", "dxf"}, []span{{}, {1, 2}}},
+		{"spans grow", "abc", []point{{0, 0}, {2, 0}}, []string{"xbx", "def"}, []span{{0, 3}, {}}},
+		{"outside", "abc", []point{{-1, 0}, {3, 0}, {0, 2}, {0, -1}}, []string{"abc", "def"}, []span{{}, {}}},
+		{"same content", "axc", []point{{1, 0}}, []string{"axc", "def"}, []span{{}, {}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			g := gridOf(test.start, "def")
+			g.resetDamage()
+			c := g.cells[0]
+			c.char = 'x'
+
+			for _, p := range test.set {
+				g.set(p.col, p.row, c)
+			}
+
+			if got := rowsOf(g); !equalRows(got, test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+
+			for row, dirty := range test.dirty {
+				if g.dirty[row] != dirty {
+					t.Errorf("row %d got damage %v, want %v", row, g.dirty[row], dirty)
+				}
+			}
+		})
+	}
+}
+
+func TestCopyRect(t *testing.T) {
+	tests := []struct {
+		name string
+		src  image.Rectangle
+		dst  image.Point
+		want []string
+	}{
+		{"overlapping", image.Rect(0, 0, 2, 2), image.Pt(1, 1), []string{"abcd", "eabh", "iefl"}},
+		{"to the left", image.Rect(1, 0, 4, 1), image.Pt(0, 0), []string{"bcdd", "efgh", "ijkl"}},
+		{"source outside", image.Rect(2, 0, 6, 1), image.Pt(0, 1), []string{"abcd", "cd  ", "ijkl"}},
+		{"past the edge", image.Rect(0, 0, 4, 1), image.Pt(2, 2), []string{"abcd", "efgh", "ijab"}},
+		{"before the edge", image.Rect(0, 0, 2, 2), image.Pt(-1, -1), []string{"fbcd", "efgh", "ijkl"}},
+		{"far outside", image.Rect(0, 0, 2, 2), image.Pt(100, -100), []string{"abcd", "efgh", "ijkl"}},
+		{"empty", image.Rect(1, 1, 1, 3), image.Pt(0, 0), []string{"abcd", "efgh", "ijkl"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			g := gridOf("abcd", "efgh", "ijkl")
+			g.copyRect(test.src, test.dst)
+
+			if got := rowsOf(g); !equalRows(got, test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+// wideCell returns a cell with a wide character
+func wideCell(char rune) cell {
+	c := emptyCell()
+	c.setCluster(string(char), 2)
+	return c
+}
+
+func TestPutWide(t *testing.T) {
+	tests := []struct {
+		name string
+		col  int
+		want string
+	}{
+		{"first column", 0, "一一cd"},
+		{"second column", 1, "a一一d"},
+		{"last column", 3, "abcd"},
+		{"outside", 4, "abcd"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			g := gridOf("abcd")
+			g.put(test.col, 0, wideCell('一'))
+
+			if got := rowsOf(g)[0]; got != test.want {
+				t.Fatalf("got %q, want %q", got, test.want)
+			}
+
+			for col, c := range g.cells {
+				wide := col == test.col && test.col < 3
+				continuation := col == test.col+1 && test.col < 3
+
+				if (c.attrs&attrWide != 0) != wide || (c.attrs&attrContinuation != 0) != continuation {
+					t.Errorf("column %d got attributes %b", col, c.attrs)
+				}
+			}
+		})
+	}
+}
+
+func TestBreakWide(t *testing.T) {
+	tests := []struct {
+		name string
+		col  int
+		want string
+	}{
+		{"left half", 1, "ax d"},
+		{"right half", 2, "a xd"},
+		{"next to it", 3, "a一一x"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			g := gridOf("abcd")
+			g.put(1, 0, wideCell('一'))
+			c := emptyCell()
+			c.char = 'x'
+			g.set(test.col, 0, c)
+
+			if got := rowsOf(g)[0]; got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+
+			for col, c := range g.cells {
+				if c.char != '一' && c.attrs&attrWidth != 0 {
+					t.Errorf("column %d kept attributes %b", col, c.attrs)
+				}
+			}
+		})
+	}
+}
+
+func TestResizeWide(t *testing.T) {
+	tests := []struct {
+		cols int
+		want string
+	}{
+		{4, "a一一d"},
+		{3, "a一一"},
+		{2, "a "},
+		{1, "a"},
+	}
+
+	for _, test := range tests {
+		g := gridOf("abcd")
+		g.put(1, 0, wideCell('一'))
+		g.resize(test.cols, 1)
+
+		if got := rowsOf(g)[0]; got != test.want {
+			t.Errorf("resized to %d cols got %q, want %q", test.cols, got, test.want)
+		} else if last := g.cells[test.cols-1]; last.attrs&attrWide != 0 {
+			t.Errorf("resized to %d cols kept a wide character in the last column", test.cols)
+		}
+	}
+}
+
+func TestValidGridSize(t *testing.T) {
+	tests := []struct {
+		cols, rows int
+		ok         bool
+	}{
+		{80, 24, true},
+		{maxGridCells, 1, true},
+		{1, maxGridCells, true},
+		{1024, 1024, true},
+		{1024, 1025, false},
+		{maxGridCells + 1, 1, false},
+		{0, 24, false},
+		{80, -1, false},
+		{1 << 30, 1 << 30, false},
+	}
+
+	for _, test := range tests {
+		if ok := validGridSize(test.cols, test.rows); ok != test.ok {
+			t.Errorf("validGridSize(%d, %d) = %t, want %t", test.cols, test.rows, ok, test.ok)
+		}
+	}
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/srwiley/oksvg"
+	"golang.org/x/image/draw"
+)
+
+const (
+	fitContain = "fit"
+	fitCover   = "fill"
+	fitStretch = "stretch"
+	fitNone    = "none"
+
+	// maxImageSize is the most pixels wide or high an image can be, whether decoded or scaled into a box.
+	// It is the largest texture size graphics cards commonly support
+	maxImageSize = 16384
+
+	// maxImagePixels is the most pixels an image can have in all, 256 MiB at 4 bytes a pixel
+	maxImagePixels = 64 << 20
+
+	// maxPlacements is the most scaled copies of an image kept for placing it again, they are all dropped when
+	// there are more. Cells keep showing the copies they were given
+	maxPlacements = 16
+
+	// maxUploadSize is the most bytes an image sent in chunks can have, enough for the raw pixels of the largest image
+	maxUploadSize = maxImagePixels * 4
+
+	// pendingUploadTimeout is how long an image sent in chunks is kept without getting a chunk. Uploads that timed out,
+	// like ones that never got imageEnd, are dropped when another upload starts
+	pendingUploadTimeout = time.Minute
+)
+
+var (
+	// uploadedImages holds the images sent with uploadImage by id, only touched from the main thread
+	uploadedImages = make(map[string]*uploadedImage)
+
+	fits = map[string]bool{fitContain: true, fitCover: true, fitStretch: true, fitNone: true}
+
+	zOrders = map[string]bool{"below": false, "above": true}
+
+	// pendingUploads holds the images being sent in chunks by id, only touched from the goroutine reading requests
+	pendingUploads = make(map[string]*pendingUpload)
+)
+
+// pendingUpload is an image sent in chunks, started with imageBegin and decoded on imageEnd
+type pendingUpload struct {
+	format imageFormat
+	data   bytes.Buffer
+
+	// updated is when the upload started or last got a chunk
+	updated time.Time
+}
+
+// dropTimedOutUploads forgets the pending uploads that got no chunk for pendingUploadTimeout
+func dropTimedOutUploads() {
+	for id, pending := range pendingUploads {
+		if time.Since(pending.updated) > pendingUploadTimeout {
+			delete(pendingUploads, id)
+		}
+	}
+}
+
+// imageFormat tells how the data of an uploaded image is decoded. Encoded images are decoded by their file format,
+// raw images are width x height pixels of 8 bit red, green, blue & alpha, row by row and not premultiplied
+type imageFormat struct {
+	raw    bool
+	width  int
+	height int
+}
+
+// size returns the most bytes an image of the format can have, raw images having exactly that many
+func (format imageFormat) size() int {
+	if !format.raw {
+		return maxUploadSize
+	}
+
+	// width x height is at most maxImagePixels, so this can not overflow
+	return format.width * format.height * 4
+}
+
+func (format imageFormat) decode(data []byte) (*uploadedImage, error) {
+	if !format.raw {
+		return decodeImage(data)
+	}
+
+	if size := format.size(); len(data) != size {
+		return nil, errors.Errorf("raw image of %d x %d pixels needs %d bytes, got %d",
+			format.width, format.height, size, len(data))
+	}
+
+	img := &image.NRGBA{Pix: data, Stride: format.width * 4, Rect: image.Rect(0, 0, format.width, format.height)}
+	return &uploadedImage{img: img, placements: make(map[imagePlacement]image.Image)}, nil
+}
+
+// uploadedImage is a decoded image kept for placing it by id, together with the scaled copies placed so far
+// so placing it again in a box of the same size shares them, and the texture made from them.
+// anim is set for animated images, img is then their first frame. icon is set instead of img for svg images
+type uploadedImage struct {
+	img        image.Image
+	anim       *animation
+	icon       *oksvg.SvgIcon
+	placements map[imagePlacement]image.Image
+}
+
+// imagePlacement is a box of cols x rows an image is scaled into, 0 x 0 keeps the image as it is.
+// Raster images are scaled for the size of the cells at the time, svg images are drawn when shown
+type imagePlacement struct {
+	cols     int
+	rows     int
+	fit      string
+	cellSize image.Point
+}
+
+// decodeImage decodes a jpg, png, gif, webp, bmp, tiff or svg image. For animated gif and png images the frames
+// are decoded as well
+func decodeImage(data []byte) (*uploadedImage, error) {
+	decoded := &uploadedImage{placements: make(map[imagePlacement]image.Image)}
+
+	// the size is checked before decoding, so a small file claiming a huge size is not decoded.
+	// The frames of animations are bounded in all by decodeGIF & decodeAPNG
+	if config, _, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+		if config.Width > maxImageSize || config.Height > maxImageSize {
+			return nil, errors.Errorf("image of %d x %d pixels is larger than %d", config.Width, config.Height,
+				maxImageSize)
+		} else if !fitsPixels(config.Width, config.Height, 1) {
+			return nil, errors.Errorf("image of %d x %d pixels has more than %d pixels", config.Width, config.Height,
+				maxImagePixels)
+		}
+	}
+
+	var err error
+
+	if bytes.HasPrefix(data, []byte("GIF8")) {
+		decoded.anim, err = decodeGIF(data)
+	} else if bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")) {
+		decoded.anim, err = decodeAPNG(data)
+	} else if isSVG(data) {
+		decoded.icon, err = decodeSVG(data)
+	}
+
+	if err != nil {
+		return nil, errors.WithMessage(err, "could not decode image")
+	} else if decoded.anim != nil {
+		decoded.img = decoded.anim.frames[0]
+		return decoded, nil
+	} else if decoded.icon != nil {
+		return decoded, nil
+	}
+
+	decoded.img, _, err = image.Decode(bytes.NewReader(data))
+
+	if err != nil {
+		return nil, errors.WithMessage(err, "could not decode image")
+	}
+
+	return decoded, nil
+}
+
+// decodeBase64Image decodes a base64 encoded image
+func decodeBase64Image(data string, format imageFormat) (*uploadedImage, error) {
+	raw, err := base64.StdEncoding.DecodeString(data)
+
+	if err != nil {
+		return nil, errors.WithMessage(err, "could not decode image")
+	}
+
+	return format.decode(raw)
+}
+
+// readImageFile decodes an image from a file
+func readImageFile(path string, format imageFormat) (*uploadedImage, error) {
+	data, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil, errors.WithMessage(err, "could not read image")
+	}
+
+	return format.decode(data)
+}
+
+// shmPath returns the file of a posix shared memory object, which shm_open keeps in /dev/shm on linux.
+// The name can start with a slash like for shm_open
+func shmPath(name string) (string, bool) {
+	name = strings.TrimPrefix(name, "/")
+
+	if name == "" || strings.Contains(name, "/") || name == "." || name == ".." {
+		return "", false
+	}
+
+	return filepath.Join("/dev/shm", name), true
+}
+
+// size returns the size of the image in pixels, the size of the view box for svg images
+func (uploaded *uploadedImage) size() image.Point {
+	if uploaded.icon != nil {
+		return image.Pt(int(math.Ceil(uploaded.icon.ViewBox.W)), int(math.Ceil(uploaded.icon.ViewBox.H)))
+	}
+
+	return uploaded.img.Bounds().Size()
+}
+
+// frames returns the number of frames of the image, 1 if it is not animated
+func (uploaded *uploadedImage) frames() int {
+	if uploaded.anim == nil {
+		return 1
+	}
+
+	return len(uploaded.anim.frames)
+}
+
+// fitsPixels tells if count images of width x height pixels have at most maxImagePixels in all, without overflowing
+func fitsPixels(width, height, count int) bool {
+	return width > 0 && height > 0 && count > 0 && width <= maxImagePixels/height/count
+}
+
+// checkBox returns an error if a box of width x height pixels is too large to scale count images into
+func checkBox(width, height, count int) error {
+	if width > maxImageSize || height > maxImageSize {
+		return errors.Errorf("image request got box of %d x %d pixels, more than %d", width, height, maxImageSize)
+	} else if !fitsPixels(width, height, count) {
+		return errors.Errorf("image request got box of %d x %d pixels for %d frames, more than %d pixels in all",
+			width, height, count, maxImagePixels)
+	}
+
+	return nil
+}
+
+// fitRect returns where an image of w x h pixels goes in a box of size, centered in it. fit keeps the aspect ratio
+// and shows all of the image, fill keeps the aspect ratio and covers the box, stretch covers the box and none keeps
+// the size
+func fitRect(w, h float64, size image.Point, fit string) (x, y, scaledW, scaledH float64) {
+	scaleX, scaleY := float64(size.X)/w, float64(size.Y)/h
+
+	switch fit {
+	case fitContain:
+		scaleX = math.Min(scaleX, scaleY)
+		scaleY = scaleX
+	case fitCover:
+		scaleX = math.Max(scaleX, scaleY)
+		scaleY = scaleX
+	case fitNone:
+		scaleX, scaleY = 1, 1
+	}
+
+	scaledW, scaledH = w*scaleX, h*scaleY
+	return (float64(size.X) - scaledW) / 2, (float64(size.Y) - scaledH) / 2, scaledW, scaledH
+}
+
+// placeImage scales img into a box of size pixels, placed by fitRect
+func placeImage(img image.Image, size image.Point, fit string) image.Image {
+	bounds := img.Bounds()
+	w, h := float64(bounds.Dx()), float64(bounds.Dy())
+	x, y, scaledW, scaledH := fitRect(w, h, size, fit)
+
+	scaled := image.Pt(int(math.Round(scaledW)), int(math.Round(scaledH)))
+	offset := image.Pt(int(math.Floor(x)), int(math.Floor(y)))
+	placed := image.NewNRGBA(image.Rectangle{Max: size})
+
+	if fit == fitNone {
+		draw.Draw(placed, image.Rectangle{Min: offset, Max: offset.Add(scaled)}, img, bounds.Min, draw.Src)
+	} else {
+		draw.CatmullRom.Scale(placed, image.Rectangle{Min: offset, Max: offset.Add(scaled)}, img, bounds, draw.Src, nil)
+	}
+
+	return placed
+}
+
+type uploadImageDrawRequest struct {
+	id    string
+	image *uploadedImage
+}
+
+func (req uploadImageDrawRequest) apply(g *grid) {
+	if req.image.anim != nil {
+		req.image.anim.due = time.Now().Add(req.image.anim.delays[0])
+	}
+
+	uploadedImages[req.id] = req.image
+}
+
+// imageDrawRequest places an image over the cells in a box of cols x rows starting at col & row.
+// The image is either sent with the request or uploaded before and placed by id, only uploaded animations are played.
+// When cols & rows are 0 the box is the size of the image, when one of them is 0 it follows the aspect ratio
+type imageDrawRequest struct {
+	image *uploadedImage
+	id    string
+	col   int
+	row   int
+	cols  int
+	rows  int
+	fit   string
+	above bool
+}
+
+func (req imageDrawRequest) apply(g *grid) {
+	uploaded := req.image
+
+	if uploaded == nil {
+		var ok bool
+		uploaded, ok = uploadedImages[req.id]
+
+		if !ok {
+			sendError(errors.Errorf("image request got unknown id %q", req.id))
+			return
+		}
+	}
+
+	size := uploaded.size()
+	placement := imagePlacement{cols: req.cols, rows: req.rows, fit: req.fit}
+
+	if placement.cols == 0 && placement.rows == 0 {
+		placement.cols = int(math.Ceil(float64(size.X) / float64(colWidth)))
+		placement.rows = int(math.Ceil(float64(size.Y) / float64(rowHeight)))
+		placement.fit = fitContain
+	} else if placement.cols == 0 {
+		placement.cols = int(math.Ceil(float64(placement.rows*rowHeight*size.X) / float64(size.Y*colWidth)))
+	} else if placement.rows == 0 {
+		placement.rows = int(math.Ceil(float64(placement.cols*colWidth*size.Y) / float64(size.X*rowHeight)))
+	}
+
+	cols, rows := placement.cols, placement.rows
+
+	// raster images are shown at their own size, svg images keep filling the box they were given when the
+	// size of the cells changes
+	if req.cols == 0 && req.rows == 0 && uploaded.icon == nil {
+		placement = imagePlacement{}
+	}
+
+	if placement.cols != 0 {
+		if err := checkBox(cols*colWidth, rows*rowHeight, uploaded.frames()); err != nil {
+			sendError(err)
+			return
+		}
+	}
+
+	img := uploaded.placement(placement)
+
+	// only the part of the box inside the grid is set
+	box := image.Rectangle{Min: image.Pt(req.col, req.row), Max: image.Pt(req.col+cols, req.row+rows)}
+	box = box.Intersect(image.Rect(0, 0, g.cols, g.rows))
+
+	for row := box.Min.Y; row < box.Max.Y; row++ {
+		for col := box.Min.X; col < box.Max.X; col++ {
+			c := emptyCell()
+			c.img = img
+			c.imgOffset = image.Pt(col-req.col, row-req.row)
+			c.imgID = req.id
+			c.imgAbove = req.above
+			g.set(col, row, c)
+		}
+	}
+}
+
+// placement returns the image scaled into a box, scaling it the first time
+func (uploaded *uploadedImage) placement(placement imagePlacement) image.Image {
+	if uploaded.icon == nil && placement.cols != 0 {
+		placement.cellSize = image.Pt(colWidth, rowHeight)
+	}
+
+	if placed, ok := uploaded.placements[placement]; ok {
+		return placed
+	}
+
+	scale := func(img image.Image) image.Image {
+		if placement.cols == 0 {
+			return img
+		}
+
+		return placeImage(img, image.Pt(placement.cols*colWidth, placement.rows*rowHeight), placement.fit)
+	}
+
+	var placed image.Image
+
+	if uploaded.icon != nil {
+		placed = &vectorPlacement{icon: uploaded.icon, cols: placement.cols, rows: placement.rows, fit: placement.fit}
+	} else if uploaded.anim != nil {
+		animated := &animatedPlacement{anim: uploaded.anim}
+
+		for _, frame := range uploaded.anim.frames {
+			animated.frames = append(animated.frames, scale(frame))
+		}
+
+		placed = animated
+	} else {
+		placed = scale(uploaded.img)
+	}
+
+	if len(uploaded.placements) >= maxPlacements {
+		uploaded.placements = make(map[imagePlacement]image.Image)
+	}
+
+	uploaded.placements[placement] = placed
+	return placed
+}
+
+// deleteImageDrawRequest forgets an uploaded image and removes it from the cells showing it, on the screen and all layers
+type deleteImageDrawRequest struct {
+	id string
+}
+
+func (req deleteImageDrawRequest) apply(*grid) {
+	if _, ok := uploadedImages[req.id]; !ok {
+		sendError(errors.Errorf("deleteImage request got unknown id %q", req.id))
+		return
+	}
+
+	delete(uploadedImages, req.id)
+
+	for _, g := range grids() {
+		for i, c := range g.cells {
+			if c.img == nil || c.imgID != req.id {
+				continue
+			}
+
+			c.img = nil
+			c.imgOffset = image.Point{}
+			c.imgID = ""
+			c.imgAbove = false
+			g.set(i%g.cols, i/g.cols, c)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+	"time"
+)
+
+func TestPlaceImage(t *testing.T) {
+	red := color.NRGBA{R: 255, A: 255}
+	img := image.NewNRGBA(image.Rect(0, 0, 4, 2))
+
+	for i := 0; i < len(img.Pix); i += 4 {
+		copy(img.Pix[i:], []uint8{red.R, red.G, red.B, red.A})
+	}
+
+	tests := []struct {
+		fit  string
+		size image.Point
+		// the part of the box covered by the image
+		covered image.Rectangle
+	}{
+		{fitContain, image.Pt(8, 8), image.Rect(0, 2, 8, 6)},
+		{fitCover, image.Pt(8, 8), image.Rect(0, 0, 8, 8)},
+		{fitStretch, image.Pt(8, 8), image.Rect(0, 0, 8, 8)},
+		{fitNone, image.Pt(8, 8), image.Rect(2, 3, 6, 5)},
+		{fitNone, image.Pt(2, 2), image.Rect(0, 0, 2, 2)},
+	}
+
+	for _, test := range tests {
+		placed := placeImage(img, test.size, test.fit)
+
+		if placed.Bounds() != (image.Rectangle{Max: test.size}) {
+			t.Errorf("%s got bounds %v, want %v", test.fit, placed.Bounds(), test.size)
+			continue
+		}
+
+		for y := 0; y < test.size.Y; y++ {
+			for x := 0; x < test.size.X; x++ {
+				_, _, _, a := placed.At(x, y).RGBA()
+
+				if covered := image.Pt(x, y).In(test.covered); covered != (a == 0xffff) {
+					t.Errorf("%s in %v got alpha %d at %d, %d", test.fit, test.size, a, x, y)
+				}
+			}
+		}
+	}
+}
+
+func TestCheckBox(t *testing.T) {
+	tests := []struct {
+		width, height, count int
+		ok                   bool
+	}{
+		{100, 100, 1, true},
+		{maxImageSize, maxImagePixels / maxImageSize, 1, true},
+		{maxImageSize, maxImagePixels / maxImageSize, 2, false},
+		{maxImageSize + 1, 1, 1, false},
+		{1, maxImageSize + 1, 1, false},
+		{8192, 8192, 1, true},
+		{8192, 8193, 1, false},
+		{100, 100, maxImagePixels / 10000, true},
+		{100, 100, maxImagePixels/10000 + 1, false},
+		{0, 100, 1, false},
+		{100, 100, 0, false},
+	}
+
+	for _, test := range tests {
+		if err := checkBox(test.width, test.height, test.count); (err == nil) != test.ok {
+			t.Errorf("checkBox(%d, %d, %d) = %v, want ok: %t", test.width, test.height, test.count, err, test.ok)
+		}
+	}
+}
+
+func TestFitRect(t *testing.T) {
+	tests := []struct {
+		fit                    string
+		x, y, scaledW, scaledH float64
+	}{
+		{fitContain, 0, 37.5, 100, 25},
+		{fitCover, -150, 0, 400, 100},
+		{fitStretch, 0, 0, 100, 100},
+		{fitNone, 30, 45, 40, 10},
+	}
+
+	for _, test := range tests {
+		x, y, w, h := fitRect(40, 10, image.Pt(100, 100), test.fit)
+
+		if x != test.x || y != test.y || w != test.scaledW || h != test.scaledH {
+			t.Errorf("%s got %g, %g, %g x %g, want %g, %g, %g x %g", test.fit, x, y, w, h,
+				test.x, test.y, test.scaledW, test.scaledH)
+		}
+	}
+}
+
+func TestImageFormat(t *testing.T) {
+	n := func(i int) *int { return &i }
+	s := func(s string) *string { return &s }
+
+	tests := []struct {
+		name string
+		req  imageFormatRequest
+		size int
+		ok   bool
+	}{
+		{"encoded by default", imageFormatRequest{}, maxUploadSize, true},
+		{"encoded", imageFormatRequest{Format: s("encoded")}, maxUploadSize, true},
+		{"raw", imageFormatRequest{Format: s("rgba"), Width: n(3), Height: n(2)}, 24, true},
+		{"largest raw", imageFormatRequest{Format: s("rgba"), Width: n(maxImageSize), Height: n(4096)}, maxUploadSize, true},
+		{"unknown format", imageFormatRequest{Format: s("yuv")}, 0, false},
+		{"missing height", imageFormatRequest{Format: s("rgba"), Width: n(3)}, 0, false},
+		{"zero width", imageFormatRequest{Format: s("rgba"), Width: n(0), Height: n(2)}, 0, false},
+		{"too wide", imageFormatRequest{Format: s("rgba"), Width: n(maxImageSize + 1), Height: n(1)}, 0, false},
+		{"too many pixels", imageFormatRequest{Format: s("rgba"), Width: n(maxImageSize), Height: n(4097)}, 0, false},
+	}
+
+	for _, test := range tests {
+		format, err := test.req.imageFormat("imageBegin")
+
+		if (err == nil) != test.ok {
+			t.Errorf("%s got error %v, want ok: %t", test.name, err, test.ok)
+		} else if test.ok && format.size() != test.size {
+			t.Errorf("%s got size %d, want %d", test.name, format.size(), test.size)
+		}
+	}
+}
+
+func TestPendingUploads(t *testing.T) {
+	defer func() { pendingUploads = make(map[string]*pendingUpload) }()
+
+	send := func(line string) error {
+		_, err := parseRequest(nil, []byte(line))
+		return err
+	}
+
+	if err := send(`{"type": "imageBegin", "id": "a", "format": "rgba", "width": 2, "height": 1}`); err != nil {
+		t.Fatal(err)
+	} else if err := send(`{"type": "imageChunk", "id": "a", "data": "AAAAAAAA"}`); err != nil {
+		t.Fatal(err)
+	}
+
+	// another 6 bytes make 12, more than the 8 of a 2 x 1 image, which drops the upload
+	if err := send(`{"type": "imageChunk", "id": "a", "data": "AAAAAAAA"}`); err == nil {
+		t.Error("chunk past the size of the image was accepted")
+	} else if _, ok := pendingUploads["a"]; ok {
+		t.Error("upload was kept after getting too many bytes")
+	}
+
+	if err := send(`{"type": "imageEnd", "id": "a"}`); err == nil {
+		t.Error("dropped upload was ended")
+	}
+
+	if err := send(`{"type": "imageBegin", "id": "old"}`); err != nil {
+		t.Fatal(err)
+	}
+
+	pendingUploads["old"].updated = time.Now().Add(-pendingUploadTimeout - time.Second)
+
+	if err := send(`{"type": "imageBegin", "id": "new"}`); err != nil {
+		t.Fatal(err)
+	} else if _, ok := pendingUploads["old"]; ok {
+		t.Error("timed out upload was kept")
+	} else if _, ok := pendingUploads["new"]; !ok {
+		t.Error("new upload was dropped")
+	}
+}
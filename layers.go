@@ -0,0 +1,248 @@
+package main
+
+import (
+	"image"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// layers are grids of their own drawn over the screen, so something like a dialog can be shown and hidden
+	// without drawing again what is below it. Only touched from the main thread
+	layers = make(map[string]*layer)
+
+	// layersCreated counts the layers created so far, layers with the same zIndex are drawn in the order they were created
+	layersCreated int
+)
+
+type layer struct {
+	grid *grid
+
+	// col & row is where the top left cell of the layer is on the screen
+	col int
+	row int
+
+	visible bool
+	opacity float64
+	zIndex  int
+	created int
+
+	// renderer is made the first time the layer is shown, sharing the glyph atlas of the screen
+	renderer *renderer
+}
+
+// grids returns the screen and the grids of all panes and layers
+func grids() []*grid {
+	all := []*grid{screen}
+
+	for _, p := range panes {
+		all = append(all, p.grid)
+	}
+
+	for _, l := range layers {
+		all = append(all, l.grid)
+	}
+
+	return all
+}
+
+// visibleGrids returns the grids that are drawn: the screen, the panes and the visible layers
+func visibleGrids() []*grid {
+	visible := []*grid{screen}
+
+	for _, p := range panes {
+		visible = append(visible, p.grid)
+	}
+
+	for _, l := range visibleLayers() {
+		visible = append(visible, l.grid)
+	}
+
+	return visible
+}
+
+// visibleLayers returns the layers that are shown, in the order they are drawn
+func visibleLayers() []*layer {
+	var visible []*layer
+
+	for _, l := range layers {
+		if l.visible {
+			visible = append(visible, l)
+		}
+	}
+
+	sort.Slice(visible, func(i, j int) bool {
+		if visible[i].zIndex != visible[j].zIndex {
+			return visible[i].zIndex < visible[j].zIndex
+		}
+
+		return visible[i].created < visible[j].created
+	})
+
+	return visible
+}
+
+// updateRenderers brings the renderers of the screen, the panes and the visible layers up to date with their grids.
+// Since they share the glyph atlas, the ones updated before it filled up are updated again.
+// Returns true if anything changed
+func updateRenderers(base *renderer) bool {
+	changed := false
+
+	update := func(r *renderer, g *grid) {
+		if g.damaged() || r.stale() {
+			r.update(g)
+			changed = true
+		}
+	}
+
+	for attempt := 0; attempt < 2; attempt++ {
+		generation := base.atlas.generation
+		update(base, screen)
+
+		for _, p := range panes {
+			if p.renderer == nil {
+				p.renderer = newRenderer(base.atlas)
+			}
+
+			update(p.renderer, p.grid)
+		}
+
+		for _, l := range visibleLayers() {
+			if l.renderer == nil {
+				l.renderer = newRenderer(base.atlas)
+			}
+
+			if l.renderer.opacity != l.opacity {
+				l.renderer.opacity = l.opacity
+				l.grid.markAllDirty()
+			}
+
+			update(l.renderer, l.grid)
+		}
+
+		if base.atlas.generation == generation {
+			break
+		}
+	}
+
+	return changed
+}
+
+// drawLayers draws the screen with the panes and then the visible layers over it. width & height is the window size,
+// while the framebuffer size can be larger on high dpi screens
+func drawLayers(base *renderer, width, height, framebufferWidth, framebufferHeight int) {
+	clearFrame(width, height, framebufferWidth, framebufferHeight)
+	base.draw(image.Point{})
+	drawPanes(width, height, framebufferWidth, framebufferHeight)
+
+	for _, l := range visibleLayers() {
+		if l.renderer != nil {
+			l.renderer.draw(image.Pt(l.col*colWidth, l.row*rowHeight))
+		}
+	}
+}
+
+// setLayerDrawRequest creates a layer, or changes the fields sent for one that exists
+type setLayerDrawRequest struct {
+	req layerRequest
+}
+
+func (req setLayerDrawRequest) apply(*grid) {
+	r := req.req
+	l, ok := layers[*r.Name]
+
+	if !ok && r.Cols == nil {
+		sendError(errors.Errorf("layer request is missing \"cols\" field to create layer %q", *r.Name))
+		return
+	} else if !ok && r.Rows == nil {
+		sendError(errors.Errorf("layer request is missing \"rows\" field to create layer %q", *r.Name))
+		return
+	}
+
+	var cols, rows int
+
+	if ok {
+		cols, rows = l.grid.cols, l.grid.rows
+	}
+
+	if r.Cols != nil {
+		cols = *r.Cols
+	}
+
+	if r.Rows != nil {
+		rows = *r.Rows
+	}
+
+	if !validGridSize(cols, rows) {
+		sendError(errors.Errorf("layer request got size %d x %d, more than %d cells", cols, rows, maxGridCells))
+		return
+	}
+
+	if !ok {
+		layersCreated++
+		l = &layer{grid: newGrid(cols, rows), visible: true, opacity: 1, created: layersCreated}
+		layers[*r.Name] = l
+	} else {
+		l.grid.resize(cols, rows)
+	}
+
+	if r.Col != nil {
+		l.col = *r.Col
+	}
+
+	if r.Row != nil {
+		l.row = *r.Row
+	}
+
+	if r.Visible != nil {
+		l.visible = *r.Visible
+	}
+
+	if r.Opacity != nil {
+		l.opacity = *r.Opacity
+	}
+
+	if r.ZIndex != nil {
+		l.zIndex = *r.ZIndex
+	}
+
+	requestRedraw()
+}
+
+type deleteLayerDrawRequest struct {
+	name string
+}
+
+func (req deleteLayerDrawRequest) apply(*grid) {
+	l, ok := layers[req.name]
+
+	if !ok {
+		sendError(errors.Errorf("deleteLayer request got unknown name %q", req.name))
+		return
+	}
+
+	if l.renderer != nil {
+		l.renderer.free()
+	}
+
+	delete(layers, req.name)
+	requestRedraw()
+}
+
+// onLayerDrawRequest applies a request sent with a layer to the grid of that layer instead of the screen
+type onLayerDrawRequest struct {
+	layer string
+	req   drawRequest
+}
+
+func (req onLayerDrawRequest) apply(*grid) {
+	l, ok := layers[req.layer]
+
+	if !ok {
+		sendError(errors.Errorf("request got unknown layer %q", req.layer))
+		return
+	}
+
+	req.req.apply(l.grid)
+}
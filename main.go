@@ -2,11 +2,12 @@ package main
 
 import (
 	"bufio"
+	"flag"
 	"fmt"
 	"io"
-	"log"
 	"os"
 	"runtime"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
@@ -19,17 +20,41 @@ func init() {
 	runtime.LockOSThread()
 }
 
-const (
-	colWidth  = 12
-	rowHeight = 24
-)
-
 var (
 	cols int
 	rows int
+
+	// size of a cell in pixels, set from the font metrics when loading fonts
+	colWidth  int
+	rowHeight int
+)
+
+var (
+	metricsInterval = flag.Duration("metrics-interval", 0, "send a metrics event this often, 0 turns it off")
+	metricsFile     = flag.String("metrics-file", "", "write the timings of every frame to this file")
+	themeFile       = flag.String("theme", "", "load the theme from this file, same format as the theme request")
+
+	fontSizeFlag       = flag.Float64("font-size", 18, "font size in pixels")
+	lineSpacingFlag    = flag.Float64("line-spacing", 1, "scales the height of the rows, 1 is the line height of the font")
+	fontFamilyFlag     = flag.String("font-family", "", "name of an installed font family to use instead of the embedded font")
+	fontRegularFlag    = flag.String("font-regular", "", "path to a ttf or otf file for the regular face")
+	fontBoldFlag       = flag.String("font-bold", "", "path to a ttf or otf file for the bold face")
+	fontItalicFlag     = flag.String("font-italic", "", "path to a ttf or otf file for the italic face")
+	fontBoldItalicFlag = flag.String("font-bold-italic", "", "path to a ttf or otf file for the bold italic face")
+	emojiFontFlag      = flag.String("emoji-font", "", "path to a font with COLR or CBDT color glyphs, used for emoji")
+	shapingFlag        = flag.Bool("shaping", false, "shape runs of text with the same style, for ligatures and complex scripts")
+	fontFallbackFlag   = flag.String("font-fallback", "", "comma separated paths to fonts used, in order, for characters missing from the main font")
+)
+
+// a frame applies at most maxRequestsPerFrame requests, for at most maxRequestTime, before drawing
+const (
+	maxRequestsPerFrame = 512
+	maxRequestTime      = 8 * time.Millisecond
 )
 
 func main() {
+	flag.Parse()
+
 	err := glfw.Init()
 
 	if err != nil {
@@ -57,6 +82,7 @@ func main() {
 
 	win.Show()
 	win.MakeContextCurrent()
+	glfw.SwapInterval(1)
 
 	err = gl.Init()
 	if err != nil {
@@ -64,12 +90,37 @@ func main() {
 		return
 	}
 
-	loadFonts(18)
+	err = loadFonts(fontSize, fontFiles{}, nil)
+
+	if err != nil {
+		sendError(err)
+		return
+	}
+
 	setupCallbacks(win)
 
+	if fontReq, err := fontFlags().drawRequest(win); err != nil {
+		sendError(err)
+	} else {
+		fontReq.apply(screen)
+	}
+
+	if *themeFile != "" {
+		req, err := loadTheme(*themeFile)
+
+		if err != nil {
+			sendError(err)
+		} else {
+			currentTheme = req.theme()
+		}
+	}
+
+	windowWidth, windowHeight := win.GetSize()
+	sizeCallback(win, windowWidth, windowHeight)
+
 	fmt.Println("RUNNING")
 
-	quit := make(chan struct{})
+	quit := make(chan struct{}, 1)
 
 	go func() {
 		stdIn := bufio.NewReader(os.Stdin)
@@ -79,6 +130,8 @@ func main() {
 
 			if err == io.EOF {
 				quit <- struct{}{}
+				glfw.PostEmptyEvent()
+				return
 			} else if err != nil {
 				sendError(errors.WithMessage(err, "could not read line"))
 			}
@@ -88,18 +141,39 @@ func main() {
 			if err != nil {
 				sendError(err)
 			}
+
+			// wakes up the main loop so the request is applied right away
+			glfw.PostEmptyEvent()
 		}
 	}()
 
-	//outImg := image.NewRGBA(image.Rect(0, 0, 1920, 1080))
+	screenRenderer = newRenderer(newGlyphAtlas())
+	needRedraw := true
+	lastBlink := time.Now()
+
+	if *metricsFile != "" {
+		file, err := os.OpenFile(*metricsFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+
+		if err != nil {
+			sendError(errors.WithMessage(err, "could not open metrics file"))
+		} else {
+			defer file.Close()
+			metrics.sink = file
+		}
+	}
 
-	logFile, _ := os.OpenFile("perf.log", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
-	defer logFile.Close()
-	logger := log.New(logFile, "", 0)
+	if *metricsInterval > 0 {
+		go func() {
+			for range time.Tick(*metricsInterval) {
+				drawRequests <- metricsDrawRequest{}
+				glfw.PostEmptyEvent()
+			}
+		}()
+	}
 
+	// the loop sleeps in WaitEvents until there is input, a window event or a request posted from the stdin goroutine
 	for !win.ShouldClose() {
 		start := time.Now()
-		//needRedraw := false
 
 		select {
 		case <-quit:
@@ -108,58 +182,134 @@ func main() {
 
 		}
 
-		//drawLoop:
-		//	for {
-		//		select {
-		//		case req := <-drawRequests:
-		//			req.draw(outImg)
-		//			needRedraw = true
-		//		case <-resized:
-		//			needRedraw = true
-		//		default:
-		//			break drawLoop
-		//		}
-		//	}
-
-		logger.Println("draw requests:\t", time.Now().Sub(start))
-		glTime := time.Now()
-
-		windowWidth, windowHeight := win.GetSize()
-
-		//bounds := outImg.Bounds()
-		//imgWidth, imgHeight := bounds.Dx(), bounds.Dy()
-
-		gl.RasterPos2f(-1, 1)
-		gl.PixelZoom(1, -1)
-		gl.Viewport(0, 0, int32(windowWidth), int32(windowHeight))
-
-		//if needRedraw {
-		//	gl.DrawPixels(
-		//		int32(imgWidth), int32(imgHeight),
-		//		gl.RGBA, gl.UNSIGNED_BYTE,
-		//		unsafe.Pointer(&outImg.Pix[0]))
-		//}
-
-		diff := time.Now().Sub(start)
-		logger.Println("gl drawing:\t\t", time.Now().Sub(glTime))
-		logger.Println("total:\t\t\t", diff)
-		logger.Println()
-
-		win.SwapBuffers()
-		glfw.PollEvents()
-
-		if diff < 30*time.Millisecond {
-			time.Sleep(30*time.Millisecond - diff)
+		// requests left over for the next frame, so a flood of them doesn't hold up drawing. A batch is one request
+		pending := false
+
+	drawLoop:
+		for applied := 0; ; applied++ {
+			if applied == maxRequestsPerFrame || time.Since(start) >= maxRequestTime {
+				pending = len(drawRequests) > 0
+				break
+			}
+
+			select {
+			case req := <-drawRequests:
+				req.apply(screen)
+			case <-redraw:
+				needRedraw = true
+			default:
+				break drawLoop
+			}
+		}
+
+		requestTime := time.Now().Sub(start)
+
+		if time.Since(lastBlink) >= blinkInterval {
+			blinkVisible = !blinkVisible
+			lastBlink = time.Now()
+
+			for _, g := range grids() {
+				g.markBlinkingDirty()
+			}
+		}
+
+		advanceAnimations()
+
+		var uploadTime, frameTime time.Duration
+		uploadStart := time.Now()
+
+		if updateRenderers(screenRenderer) {
+			uploadTime = time.Now().Sub(uploadStart)
+			needRedraw = true
+		}
+
+		if needRedraw {
+			windowWidth, windowHeight := win.GetSize()
+			framebufferWidth, framebufferHeight := win.GetFramebufferSize()
+			drawLayers(screenRenderer, windowWidth, windowHeight, framebufferWidth, framebufferHeight)
+
+			// measured before swapping, since that blocks until the next vertical blank
+			frameTime = time.Now().Sub(start)
+			win.SwapBuffers()
+			needRedraw = false
+		}
+
+		metrics.record(requestTime, uploadTime, frameTime)
+
+		// blinking cells and playing animations need the loop to wake up on its own
+		wait, wake := blinkInterval-time.Since(lastBlink), false
+
+		for _, g := range grids() {
+			wake = wake || g.blinking > 0
+		}
+
+		if untilFrame, playing := nextFrame(); playing && (!wake || untilFrame < wait) {
+			wait, wake = untilFrame, true
+		}
+
+		if pending {
+			glfw.PollEvents()
+		} else if wake && wait > 0 {
+			glfw.WaitEventsTimeout(wait.Seconds())
+		} else if wake {
+			glfw.PollEvents()
+		} else {
+			glfw.WaitEvents()
 		}
 	}
 }
 
+// fontFlags turns the font flags into a font request
+func fontFlags() fontRequest {
+	req := fontRequest{Size: fontSizeFlag, LineSpacing: lineSpacingFlag}
+
+	if *fontFamilyFlag != "" {
+		req.Family = fontFamilyFlag
+	}
+
+	paths := []struct {
+		flag *string
+		src  **fontSource
+	}{
+		{fontRegularFlag, &req.Regular},
+		{fontBoldFlag, &req.Bold},
+		{fontItalicFlag, &req.Italic},
+		{fontBoldItalicFlag, &req.BoldItalic},
+	}
+
+	for _, path := range paths {
+		if *path.flag != "" {
+			*path.src = &fontSource{Path: path.flag}
+		}
+	}
+
+	if *fontFallbackFlag != "" {
+		for _, path := range strings.Split(*fontFallbackFlag, ",") {
+			path := path
+			req.Fallback = append(req.Fallback, fontSource{Path: &path})
+		}
+	}
+
+	if *emojiFontFlag != "" {
+		req.Emoji = &fontSource{Path: emojiFontFlag}
+	}
+
+	if *shapingFlag {
+		req.Shaping = shapingFlag
+	}
+
+	return req
+}
+
 func setupCallbacks(win *glfw.Window) {
 	win.SetSizeCallback(sizeCallback)
 	win.SetCharCallback(charCallback)
 	win.SetKeyCallback(keyCallback)
 	win.SetMouseButtonCallback(mouseClickCallback)
 	win.SetCursorPosCallback(mouseMoveCallback)
+	win.SetRefreshCallback(func(_ *glfw.Window) {
+		requestRedraw()
+	})
 
 	win.SetCloseCallback(func(_ *glfw.Window) {
 		state := WindowState{}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// number of samples kept per timing, older ones are overwritten
+const metricSamples = 1024
+
+var metrics = &frameMetrics{}
+
+// samples is a ring buffer of the latest durations of something
+type samples struct {
+	values []time.Duration
+	next   int
+	count  int
+}
+
+func (s *samples) add(d time.Duration) {
+	if len(s.values) < metricSamples {
+		s.values = append(s.values, d)
+	} else {
+		s.values[s.next] = d
+	}
+
+	s.next = (s.next + 1) % metricSamples
+	s.count++
+}
+
+func (s *samples) summary() timingSummary {
+	if len(s.values) == 0 {
+		return timingSummary{}
+	}
+
+	sorted := make([]time.Duration, len(s.values))
+	copy(sorted, s.values)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	percentile := func(p int) float64 {
+		return milliseconds(sorted[(len(sorted)-1)*p/100])
+	}
+
+	return timingSummary{
+		Count: s.count,
+		P50:   percentile(50),
+		P90:   percentile(90),
+		P99:   percentile(99),
+		Max:   milliseconds(sorted[len(sorted)-1]),
+	}
+}
+
+// frameMetrics collects the timings of the main loop. Only used from the main thread
+type frameMetrics struct {
+	frame    samples
+	requests samples
+	upload   samples
+
+	// sink gets one line per frame when set with the -metrics-file flag
+	sink io.Writer
+}
+
+// record adds the timings of one pass through the main loop. upload and frame are zero if nothing was drawn
+func (m *frameMetrics) record(requests, upload, frame time.Duration) {
+	m.requests.add(requests)
+
+	if frame == 0 {
+		return
+	}
+
+	m.upload.add(upload)
+	m.frame.add(frame)
+
+	if m.sink != nil {
+		_, _ = fmt.Fprintf(m.sink, "requests: %v\tupload: %v\tframe: %v\n", requests, upload, frame)
+	}
+}
+
+func (m *frameMetrics) event(name string) metricsEvent {
+	return metricsEvent{
+		Event:    name,
+		Frame:    m.frame.summary(),
+		Requests: m.requests.summary(),
+		Upload:   m.upload.summary(),
+	}
+}
+
+type statsDrawRequest struct{}
+
+func (statsDrawRequest) apply(*grid) {
+	sendResponse(metrics.event("stats"))
+}
+
+// metricsDrawRequest is sent from a ticker when periodic metrics events are turned on
+type metricsDrawRequest struct{}
+
+func (metricsDrawRequest) apply(*grid) {
+	sendResponse(metrics.event("metrics"))
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
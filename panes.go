@@ -0,0 +1,263 @@
+package main
+
+import (
+	"image"
+	"sort"
+
+	"github.com/go-gl/gl/v2.1/gl"
+	"github.com/pkg/errors"
+)
+
+var (
+	// panes are rectangular parts of the screen showing a grid of their own, drawn over the screen and below the
+	// layers. Only touched from the main thread
+	panes = make(map[string]*pane)
+
+	// panesCreated counts the panes created so far, panes created later are drawn over the ones before
+	panesCreated int
+)
+
+// pane shows the content in its grid through a box of cols x rows cells on the screen, with its top left cell at
+// col & row. The content is scrolled by scrollCol & scrollRow, and clipped to the box
+type pane struct {
+	id   string
+	grid *grid
+
+	col  int
+	row  int
+	cols int
+	rows int
+
+	scrollCol int
+	scrollRow int
+
+	// sizedContent is set when the size of the content was sent, otherwise it follows the size of the pane
+	sizedContent bool
+	created      int
+
+	// renderer is made the first time the pane is drawn, sharing the glyph atlas of the screen
+	renderer *renderer
+}
+
+// box returns the part of the screen the pane covers, in cols & rows
+func (p *pane) box() image.Rectangle {
+	return image.Rect(p.col, p.row, p.col+p.cols, p.row+p.rows)
+}
+
+// sendSize sends the size of the pane in cells, and the size of the cells in pixels
+func (p *pane) sendSize() {
+	sendResponse(paneSizeEvent{Event: "paneSize", Pane: p.id, Cols: p.cols, Rows: p.rows, ColWidth: colWidth,
+		RowHeight: rowHeight})
+}
+
+// sortedPanes returns the panes in the order they are drawn
+func sortedPanes() []*pane {
+	sorted := make([]*pane, 0, len(panes))
+
+	for _, p := range panes {
+		sorted = append(sorted, p)
+	}
+
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].created < sorted[j].created
+	})
+
+	return sorted
+}
+
+// paneAt returns the pane drawn at col & row of the screen, nil if there is none
+func paneAt(col, row int) *pane {
+	var top *pane
+
+	for _, p := range panes {
+		if image.Pt(col, row).In(p.box()) && (top == nil || p.created > top.created) {
+			top = p
+		}
+	}
+
+	return top
+}
+
+// location returns where col & row of the screen is in the pane drawn there, for mouse events
+func location(col, row int) paneLocation {
+	p := paneAt(col, row)
+
+	if p == nil {
+		return paneLocation{}
+	}
+
+	paneCol, paneRow := col-p.col+p.scrollCol, row-p.row+p.scrollRow
+	return paneLocation{Pane: p.id, PaneCol: &paneCol, PaneRow: &paneRow}
+}
+
+// drawPanes draws the panes, each clipped to its box. width & height is the window size,
+// while the framebuffer size can be larger on high dpi screens
+func drawPanes(width, height, framebufferWidth, framebufferHeight int) {
+	if width == 0 || height == 0 {
+		return
+	}
+
+	scaleX, scaleY := float64(framebufferWidth)/float64(width), float64(framebufferHeight)/float64(height)
+	gl.Enable(gl.SCISSOR_TEST)
+
+	for _, p := range sortedPanes() {
+		if p.renderer == nil {
+			continue
+		}
+
+		// the scissor box is in framebuffer pixels, counted from the bottom left corner
+		box := p.box()
+		box = image.Rect(box.Min.X*colWidth, box.Min.Y*rowHeight, box.Max.X*colWidth, box.Max.Y*rowHeight)
+		gl.Scissor(int32(float64(box.Min.X)*scaleX), int32(float64(height-box.Max.Y)*scaleY),
+			int32(float64(box.Dx())*scaleX), int32(float64(box.Dy())*scaleY))
+
+		p.renderer.draw(image.Pt((p.col-p.scrollCol)*colWidth, (p.row-p.scrollRow)*rowHeight))
+	}
+
+	gl.Disable(gl.SCISSOR_TEST)
+}
+
+// setPaneDrawRequest creates a pane for createPane, or changes the fields sent for an existing one for setPane
+type setPaneDrawRequest struct {
+	req    paneRequest
+	create bool
+}
+
+func (req setPaneDrawRequest) reqType() string {
+	if req.create {
+		return "createPane"
+	}
+
+	return "setPane"
+}
+
+func (req setPaneDrawRequest) apply(*grid) {
+	r := req.req
+	p, ok := panes[*r.ID]
+	resized := !ok
+
+	if ok && req.create {
+		sendError(errors.Errorf("createPane request got id %q of a pane that exists", *r.ID))
+		return
+	} else if !ok && !req.create {
+		sendError(errors.Errorf("setPane request got unknown id %q", *r.ID))
+		return
+	}
+
+	var cols, rows int
+
+	if ok {
+		cols, rows = p.cols, p.rows
+	}
+
+	if r.Cols != nil {
+		cols = *r.Cols
+	}
+
+	if r.Rows != nil {
+		rows = *r.Rows
+	}
+
+	contentCols, contentRows := cols, rows
+
+	if ok && p.sizedContent {
+		contentCols, contentRows = p.grid.cols, p.grid.rows
+	}
+
+	if r.ContentCols != nil {
+		contentCols = *r.ContentCols
+	}
+
+	if r.ContentRows != nil {
+		contentRows = *r.ContentRows
+	}
+
+	if !validGridSize(cols, rows) {
+		sendError(errors.Errorf("%s request got size %d x %d, more than %d cells", req.reqType(), cols, rows, maxGridCells))
+		return
+	} else if !validGridSize(contentCols, contentRows) {
+		sendError(errors.Errorf("%s request got content size %d x %d, more than %d cells", req.reqType(), contentCols,
+			contentRows, maxGridCells))
+		return
+	}
+
+	if !ok {
+		panesCreated++
+		p = &pane{id: *r.ID, col: *r.Col, row: *r.Row, cols: cols, rows: rows, created: panesCreated}
+		panes[*r.ID] = p
+	}
+
+	if r.Col != nil {
+		p.col = *r.Col
+	}
+
+	if r.Row != nil {
+		p.row = *r.Row
+	}
+
+	if cols != p.cols || rows != p.rows {
+		p.cols, p.rows = cols, rows
+		resized = true
+	}
+
+	if r.ScrollCol != nil {
+		p.scrollCol = *r.ScrollCol
+	}
+
+	if r.ScrollRow != nil {
+		p.scrollRow = *r.ScrollRow
+	}
+
+	if r.ContentCols != nil || r.ContentRows != nil {
+		p.sizedContent = true
+	}
+
+	if p.grid == nil {
+		p.grid = newGrid(contentCols, contentRows)
+	} else {
+		p.grid.resize(contentCols, contentRows)
+	}
+
+	if resized {
+		p.sendSize()
+	}
+
+	requestRedraw()
+}
+
+type deletePaneDrawRequest struct {
+	id string
+}
+
+func (req deletePaneDrawRequest) apply(*grid) {
+	p, ok := panes[req.id]
+
+	if !ok {
+		sendError(errors.Errorf("deletePane request got unknown id %q", req.id))
+		return
+	}
+
+	if p.renderer != nil {
+		p.renderer.free()
+	}
+
+	delete(panes, req.id)
+	requestRedraw()
+}
+
+// onPaneDrawRequest applies a request sent with a pane to the content of that pane instead of the screen
+type onPaneDrawRequest struct {
+	pane string
+	req  drawRequest
+}
+
+func (req onPaneDrawRequest) apply(*grid) {
+	p, ok := panes[req.pane]
+
+	if !ok {
+		sendError(errors.Errorf("request got unknown pane %q", req.pane))
+		return
+	}
+
+	req.req.apply(p.grid)
+}
@@ -0,0 +1,602 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"unsafe"
+
+	"github.com/go-gl/gl/v2.1/gl"
+)
+
+// vertices per cell in the background buffer, and in the foreground buffer where the quads are
+// background over images, glyph, underline and strikethrough
+const (
+	backgroundVertices = 4
+	foregroundVertices = 16
+)
+
+// vertex is laid out the way the fixed function pipeline reads it from the vertex buffer
+type vertex struct {
+	x, y  float32
+	u, v  float32
+	color color.RGBA
+}
+
+const vertexSize = int32(unsafe.Sizeof(vertex{}))
+
+// vertexBuffer keeps vertices on the cpu side together with the buffer object they are uploaded to
+type vertexBuffer struct {
+	vbo      uint32
+	vertices []vertex
+}
+
+func newVertexBuffer() vertexBuffer {
+	var buffer vertexBuffer
+	gl.GenBuffers(1, &buffer.vbo)
+	return buffer
+}
+
+func (buffer *vertexBuffer) resize(size int) {
+	if cap(buffer.vertices) < size {
+		buffer.vertices = make([]vertex, size)
+	}
+
+	buffer.vertices = buffer.vertices[:size]
+}
+
+func (buffer *vertexBuffer) upload() {
+	if len(buffer.vertices) == 0 {
+		return
+	}
+
+	gl.BindBuffer(gl.ARRAY_BUFFER, buffer.vbo)
+	gl.BufferData(gl.ARRAY_BUFFER, len(buffer.vertices)*int(vertexSize), gl.Ptr(&buffer.vertices[0]), gl.DYNAMIC_DRAW)
+}
+
+// uploadRange updates count vertices starting at first in the already uploaded buffer
+func (buffer *vertexBuffer) uploadRange(first, count int) {
+	gl.BindBuffer(gl.ARRAY_BUFFER, buffer.vbo)
+	gl.BufferSubData(gl.ARRAY_BUFFER, first*int(vertexSize), count*int(vertexSize), gl.Ptr(&buffer.vertices[first]))
+}
+
+// bind points the fixed function pipeline to the buffer
+func (buffer *vertexBuffer) bind() {
+	gl.BindBuffer(gl.ARRAY_BUFFER, buffer.vbo)
+	gl.VertexPointer(2, gl.FLOAT, vertexSize, gl.PtrOffset(0))
+	gl.TexCoordPointer(2, gl.FLOAT, vertexSize, gl.PtrOffset(8))
+	gl.ColorPointer(4, gl.UNSIGNED_BYTE, vertexSize, gl.PtrOffset(16))
+}
+
+type imageTexture struct {
+	texture uint32
+
+	// width & height is the size the texture covers on the screen, which its pixels are scaled to
+	width  int
+	height int
+	used   bool
+
+	// the version of a dynamic image the texture holds
+	version int
+}
+
+// dynamicImage is an image that changes while shown, like an animation or an svg image drawn at the size of
+// the cells. current is what it looks like now, and version changes each time that does.
+// current can be smaller than the bounds of the image, it is then scaled up to cover them
+type dynamicImage interface {
+	image.Image
+	current() image.Image
+	version() int
+}
+
+// imageBatch is a range of quads in the image vertex buffer drawn with the texture of an image,
+// either below or above the text
+type imageBatch struct {
+	texture uint32
+	first   int32
+	count   int32
+	above   bool
+}
+
+// renderer draws the grid as textured quads, glyphs coming from the atlas and images from their own textures.
+// Backgrounds are drawn first, then images and last everything drawn on top of them.
+// Every cell has a fixed slot in the background and foreground buffers so damaged cells can be updated in place
+type renderer struct {
+	atlas *glyphAtlas
+
+	backgrounds vertexBuffer
+	foregrounds vertexBuffer
+
+	imageVertices vertexBuffer
+	images        map[image.Image]*imageTexture
+	batches       []imageBatch
+
+	// unshaped is a row of cells drawn without shaping
+	unshaped []shapedCell
+
+	// the visual order of each row, nil for rows drawn as they are
+	layouts []*bidiLayout
+
+	// the generation of the atlas the buffers were built with, the atlas can be shared with other renderers
+	// which reset it when it fills up
+	generation int
+
+	// opacity scales the alpha of everything drawn, for layers. Each quad is faded on its own, so overlapping quads
+	// let less of what is below through than a layer faded as a whole would
+	opacity float64
+}
+
+// screenRenderer draws the screen, mouse events read the layout of its rows
+var screenRenderer *renderer
+
+func newRenderer(atlas *glyphAtlas) *renderer {
+	r := &renderer{
+		atlas:         atlas,
+		backgrounds:   newVertexBuffer(),
+		foregrounds:   newVertexBuffer(),
+		imageVertices: newVertexBuffer(),
+		images:        make(map[image.Image]*imageTexture),
+		opacity:       1,
+	}
+
+	gl.Enable(gl.TEXTURE_2D)
+	gl.Enable(gl.BLEND)
+	gl.BlendFunc(gl.SRC_ALPHA, gl.ONE_MINUS_SRC_ALPHA)
+	gl.TexEnvi(gl.TEXTURE_ENV, gl.TEXTURE_ENV_MODE, gl.MODULATE)
+
+	return r
+}
+
+// update brings the vertex buffers up to date with the damage in the grid and resets it
+func (r *renderer) update(g *grid) {
+	defer g.resetDamage()
+
+	if r.atlas.fontGeneration != fontGeneration {
+		r.atlas.reset()
+	}
+
+	if r.generation != r.atlas.generation {
+		g.markAllDirty()
+	}
+
+	if r.layoutRows(g) || g.imagesDirty {
+		r.buildImages(g)
+	}
+
+	if !g.allDirty && len(r.backgrounds.vertices) == g.cols*g.rows*backgroundVertices && r.updateDirty(g) {
+		r.generation = r.atlas.generation
+		return
+	}
+
+	// if the atlas fills up while building, the slots used so far are gone and the grid has to be walked again
+	for attempt := 0; attempt < 2; attempt++ {
+		generation := r.atlas.generation
+		r.buildCells(g)
+
+		if r.atlas.generation == generation {
+			break
+		}
+	}
+
+	r.backgrounds.upload()
+	r.foregrounds.upload()
+	r.generation = r.atlas.generation
+}
+
+// stale reports if the buffers have to be rebuilt even without damage, since the atlas was reset
+func (r *renderer) stale() bool {
+	return r.generation != r.atlas.generation || r.atlas.fontGeneration != fontGeneration
+}
+
+// free deletes the buffers and textures of the renderer, the atlas is kept
+func (r *renderer) free() {
+	gl.DeleteBuffers(1, &r.backgrounds.vbo)
+	gl.DeleteBuffers(1, &r.foregrounds.vbo)
+	gl.DeleteBuffers(1, &r.imageVertices.vbo)
+
+	for _, tex := range r.images {
+		gl.DeleteTextures(1, &tex.texture)
+	}
+
+	r.images = nil
+}
+
+// updateDirty rebuilds and uploads the dirty span of each row.
+// Returns false if the atlas was reset on the way, the whole buffer then has to be rebuilt
+func (r *renderer) updateDirty(g *grid) bool {
+	generation := r.atlas.generation
+
+	for row, dirty := range g.dirty {
+		if dirty.empty() {
+			continue
+		}
+
+		// a changed cell can change how the rest of its run is shaped
+		if shapingEnabled {
+			dirty = span{from: 0, to: g.cols}
+		}
+
+		r.rowQuads(g, row, dirty)
+
+		if r.atlas.generation != generation {
+			return false
+		}
+
+		first := row*g.cols + dirty.from
+		count := dirty.to - dirty.from
+		r.backgrounds.uploadRange(first*backgroundVertices, count*backgroundVertices)
+		r.foregrounds.uploadRange(first*foregroundVertices, count*foregroundVertices)
+	}
+
+	return true
+}
+
+func (r *renderer) buildCells(g *grid) {
+	r.backgrounds.resize(g.cols * g.rows * backgroundVertices)
+	r.foregrounds.resize(g.cols * g.rows * foregroundVertices)
+
+	for row := 0; row < g.rows; row++ {
+		r.rowQuads(g, row, span{from: 0, to: g.cols})
+	}
+}
+
+// layoutRows lays out the rows with damage again. Rows that are reordered are marked dirty as a whole,
+// since a change anywhere can move every cell. Returns true if cells showing images moved
+func (r *renderer) layoutRows(g *grid) bool {
+	if len(r.layouts) != g.rows {
+		r.layouts = make([]*bidiLayout, g.rows)
+		g.markAllDirty()
+	}
+
+	moved := false
+
+	for row, dirty := range g.dirty {
+		if dirty.empty() {
+			continue
+		}
+
+		cells := g.cells[row*g.cols : (row+1)*g.cols]
+		layout := layoutRow(cells)
+
+		if layout == nil && r.layouts[row] == nil {
+			continue
+		}
+
+		r.layouts[row] = layout
+		g.dirty[row] = span{from: 0, to: g.cols}
+
+		for _, c := range cells {
+			moved = moved || c.img != nil
+		}
+	}
+
+	return moved
+}
+
+// logicalCol returns the column in the grid of the cell drawn at col & row, after the layouts of the last update
+func (r *renderer) logicalCol(col, row int) int {
+	if row < 0 || row >= len(r.layouts) || r.layouts[row] == nil {
+		return col
+	}
+
+	layout := r.layouts[row]
+
+	if col < 0 || col >= len(layout.visual) {
+		return col
+	}
+
+	return layout.visual[col]
+}
+
+// rowQuads fills the slots of the columns in cols of a row, with the cells drawn there in visual order
+func (r *renderer) rowQuads(g *grid, row int, cols span) {
+	cells := g.cells[row*g.cols : (row+1)*g.cols]
+	layout := r.layouts[row]
+	shaped := r.shapeRow(cells, layout)
+
+	for col := cols.from; col < cols.to; col++ {
+		c := cells[col]
+
+		if layout != nil {
+			c = layout.cell(cells, col)
+		}
+
+		r.cellQuads(row*g.cols+col, c, col, row, shaped[col])
+	}
+}
+
+// shapeRow returns how the shaping stage draws each visual column of a row, nothing is shaped when shaping is off
+func (r *renderer) shapeRow(cells []cell, layout *bidiLayout) []shapedCell {
+	if !shapingEnabled {
+		if len(r.unshaped) < len(cells) {
+			r.unshaped = make([]shapedCell, len(cells))
+		}
+
+		return r.unshaped
+	}
+
+	return shapeRow(cells, layout)
+}
+
+// cellQuads fills the slots of cell i in the background and foreground buffers
+func (r *renderer) cellQuads(i int, c cell, col, row int, shaped shapedCell) {
+	background := r.backgrounds.vertices[i*backgroundVertices : (i+1)*backgroundVertices]
+	dst := r.foregrounds.vertices[i*foregroundVertices : (i+1)*foregroundVertices]
+	box := rect(col, row)
+
+	textColor, bg := c.textColor.resolve(), c.bg.resolve()
+
+	if c.attrs&attrReverse != 0 {
+		textColor, bg = bg, textColor
+	}
+
+	if c.attrs&attrDim != 0 {
+		textColor = mix(textColor, bg)
+	}
+
+	for i := range dst {
+		dst[i] = vertex{}
+	}
+
+	// behind images there is only the default background, the cell background goes on top of the image
+	// unless the image is drawn above the text
+	if c.img != nil && !c.imgAbove {
+		r.slotQuad(background, box, slotSolid, currentTheme.background)
+		r.slotQuad(dst[0:4], box, slotSolid, bg)
+	} else {
+		r.slotQuad(background, box, slotSolid, bg)
+	}
+
+	if c.attrs&attrBlink != 0 && !blinkVisible {
+		return
+	}
+
+	if shaped.shaped {
+		if shaped.pieces != "" {
+			r.slotQuad(dst[4:8], box, r.atlas.shapedGlyph(shaped.pieces, c.attrs).slot, textColor)
+		}
+	} else if c.char != ' ' || c.combining != "" {
+		glyph := r.atlas.glyph(c.char, c.combining, c.attrs)
+		glyphColor := textColor
+
+		// the right half of a wide glyph is in the slot after the left half
+		if c.attrs&attrContinuation != 0 {
+			glyph.slot++
+		}
+
+		if glyph.colored {
+			glyphColor = color.RGBA{R: 255, G: 255, B: 255, A: 255}
+		}
+
+		r.slotQuad(dst[4:8], box, glyph.slot, glyphColor)
+	}
+
+	if c.attrs&attrUnderlines != 0 {
+		underlineColor := textColor
+
+		if c.underlineColor != nil {
+			underlineColor = c.underlineColor.resolve()
+		}
+
+		slot := slotUnderline
+
+		if c.attrs&attrDoubleUnderline != 0 {
+			slot = slotDoubleUnderline
+		} else if c.attrs&attrCurlyUnderline != 0 {
+			slot = slotCurlyUnderline
+		}
+
+		r.slotQuad(dst[8:12], box, slot, underlineColor)
+	}
+
+	if c.attrs&attrStrikethrough != 0 {
+		r.slotQuad(dst[12:16], box, slotStrikethrough, textColor)
+	}
+}
+
+// slotQuad covers box with a slot of the atlas
+func (r *renderer) slotQuad(dst []vertex, box image.Rectangle, slot int, c color.RGBA) {
+	u0, v0, u1, v1 := r.atlas.texCoords(slot)
+	quad(dst, box, u0, v0, u1, v1, r.fade(c))
+}
+
+// fade applies the opacity of the renderer to a color
+func (r *renderer) fade(c color.RGBA) color.RGBA {
+	c.A = uint8(math.Round(float64(c.A) * r.opacity))
+	return c
+}
+
+// buildImages rebuilds the quads of all image fragments, grouped by texture
+func (r *renderer) buildImages(g *grid) {
+	for _, tex := range r.images {
+		tex.used = false
+	}
+
+	type batchKey struct {
+		tex   *imageTexture
+		above bool
+	}
+
+	fragments := make(map[batchKey][]vertex)
+	var order []batchKey
+
+	for row := 0; row < g.rows; row++ {
+		cells := g.cells[row*g.cols : (row+1)*g.cols]
+
+		for col := 0; col < g.cols; col++ {
+			c := cells[col]
+
+			if layout := r.layouts[row]; layout != nil {
+				c = cells[layout.visual[col]]
+			}
+
+			if c.img == nil {
+				continue
+			}
+
+			tex := r.imageTexture(c.img)
+			key := batchKey{tex: tex, above: c.imgAbove}
+
+			if _, ok := fragments[key]; !ok {
+				order = append(order, key)
+			}
+
+			box := rect(col, row)
+			offset := image.Pt(c.imgOffset.X*colWidth, c.imgOffset.Y*rowHeight)
+			part := image.Rectangle{Min: offset, Max: offset.Add(box.Size())}.
+				Intersect(image.Rect(0, 0, tex.width, tex.height))
+
+			if part.Empty() {
+				continue
+			}
+
+			box.Max = box.Min.Add(part.Size())
+			vertices := make([]vertex, 4)
+			quad(vertices, box,
+				float32(part.Min.X)/float32(tex.width), float32(part.Min.Y)/float32(tex.height),
+				float32(part.Max.X)/float32(tex.width), float32(part.Max.Y)/float32(tex.height),
+				r.fade(color.RGBA{R: 255, G: 255, B: 255, A: 255}))
+
+			fragments[key] = append(fragments[key], vertices...)
+		}
+	}
+
+	r.batches = r.batches[:0]
+	r.imageVertices.vertices = r.imageVertices.vertices[:0]
+
+	for _, key := range order {
+		r.batches = append(r.batches, imageBatch{
+			texture: key.tex.texture,
+			first:   int32(len(r.imageVertices.vertices)),
+			count:   int32(len(fragments[key])),
+			above:   key.above,
+		})
+		r.imageVertices.vertices = append(r.imageVertices.vertices, fragments[key]...)
+	}
+
+	r.imageVertices.upload()
+
+	for img, tex := range r.images {
+		if !tex.used {
+			gl.DeleteTextures(1, &tex.texture)
+			delete(r.images, img)
+		}
+	}
+}
+
+// imageTexture returns the texture of an image, uploading it the first time it is seen
+// Dynamic images are uploaded again each time they change
+func (r *renderer) imageTexture(img image.Image) *imageTexture {
+	key := img
+	tex, ok := r.images[key]
+	version := 0
+
+	// the texture covers the bounds of the image, even when the pixels uploaded are fewer
+	bounds := img.Bounds()
+
+	if dynamic, isDynamic := img.(dynamicImage); isDynamic {
+		version = dynamic.version()
+		img = dynamic.current()
+	}
+
+	if !ok {
+		tex = &imageTexture{}
+
+		gl.GenTextures(1, &tex.texture)
+		gl.BindTexture(gl.TEXTURE_2D, tex.texture)
+		gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MIN_FILTER, gl.NEAREST)
+		gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MAG_FILTER, gl.NEAREST)
+		gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_WRAP_S, gl.CLAMP_TO_EDGE)
+		gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_WRAP_T, gl.CLAMP_TO_EDGE)
+
+		r.images[key] = tex
+	}
+
+	if !ok || tex.version != version {
+		tex.width, tex.height = bounds.Dx(), bounds.Dy()
+		pixels := img.Bounds()
+		rgba := image.NewNRGBA(image.Rect(0, 0, pixels.Dx(), pixels.Dy()))
+		draw.Draw(rgba, rgba.Rect, img, pixels.Min, draw.Src)
+
+		gl.BindTexture(gl.TEXTURE_2D, tex.texture)
+		gl.PixelStorei(gl.UNPACK_ALIGNMENT, 1)
+		gl.TexImage2D(gl.TEXTURE_2D, 0, gl.RGBA, int32(rgba.Rect.Dx()), int32(rgba.Rect.Dy()), 0,
+			gl.RGBA, gl.UNSIGNED_BYTE, gl.Ptr(rgba.Pix))
+		tex.version = version
+	}
+
+	tex.used = true
+	return tex
+}
+
+// clearFrame starts a frame. width & height is the window size, which the grid is laid out in,
+// while the framebuffer size can be larger on high dpi screens
+func clearFrame(width, height, framebufferWidth, framebufferHeight int) {
+	gl.Viewport(0, 0, int32(framebufferWidth), int32(framebufferHeight))
+	gl.MatrixMode(gl.PROJECTION)
+	gl.LoadIdentity()
+	gl.Ortho(0, float64(width), float64(height), 0, -1, 1)
+
+	gl.ClearColor(
+		float32(currentTheme.background.R)/255, float32(currentTheme.background.G)/255,
+		float32(currentTheme.background.B)/255, 1)
+	gl.Clear(gl.COLOR_BUFFER_BIT)
+}
+
+// draw draws the last update with its top left corner at offset, in pixels
+func (r *renderer) draw(offset image.Point) {
+	gl.MatrixMode(gl.MODELVIEW)
+	gl.LoadIdentity()
+	gl.Translatef(float32(offset.X), float32(offset.Y), 0)
+
+	gl.EnableClientState(gl.VERTEX_ARRAY)
+	gl.EnableClientState(gl.TEXTURE_COORD_ARRAY)
+	gl.EnableClientState(gl.COLOR_ARRAY)
+
+	if len(r.backgrounds.vertices) > 0 {
+		gl.BindTexture(gl.TEXTURE_2D, r.atlas.texture)
+		r.backgrounds.bind()
+		gl.DrawArrays(gl.QUADS, 0, int32(len(r.backgrounds.vertices)))
+	}
+
+	r.drawImages(false)
+
+	if len(r.foregrounds.vertices) > 0 {
+		gl.BindTexture(gl.TEXTURE_2D, r.atlas.texture)
+		r.foregrounds.bind()
+		gl.DrawArrays(gl.QUADS, 0, int32(len(r.foregrounds.vertices)))
+	}
+
+	r.drawImages(true)
+
+	gl.DisableClientState(gl.COLOR_ARRAY)
+	gl.DisableClientState(gl.TEXTURE_COORD_ARRAY)
+	gl.DisableClientState(gl.VERTEX_ARRAY)
+}
+
+// drawImages draws the images either below or above the text
+func (r *renderer) drawImages(above bool) {
+	if len(r.batches) == 0 {
+		return
+	}
+
+	r.imageVertices.bind()
+
+	for _, batch := range r.batches {
+		if batch.above == above {
+			gl.BindTexture(gl.TEXTURE_2D, batch.texture)
+			gl.DrawArrays(gl.QUADS, batch.first, batch.count)
+		}
+	}
+}
+
+func quad(dst []vertex, box image.Rectangle, u0, v0, u1, v1 float32, c color.RGBA) {
+	x0, y0 := float32(box.Min.X), float32(box.Min.Y)
+	x1, y1 := float32(box.Max.X), float32(box.Max.Y)
+
+	dst[0] = vertex{x: x0, y: y0, u: u0, v: v0, color: c}
+	dst[1] = vertex{x: x1, y: y0, u: u1, v: v0, color: c}
+	dst[2] = vertex{x: x1, y: y1, u: u1, v: v1, color: c}
+	dst[3] = vertex{x: x0, y: y1, u: u0, v: v1, color: c}
+}
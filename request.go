@@ -1,136 +1,930 @@
 package main
 
 import (
+	"encoding/base64"
 	"encoding/json"
-	"image/color"
+	"image"
+	_ "image/gif"
 	_ "image/jpeg"
 	_ "image/png"
+	"math"
+	"strings"
+	"time"
+	"unicode"
 	"unicode/utf8"
 
 	"github.com/go-gl/glfw/v3.3/glfw"
 	"github.com/pkg/errors"
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
 )
 
 func handleRequest(win *glfw.Window, line []byte) error {
+	req, err := parseRequest(win, line)
+
+	if err != nil {
+		return err
+	} else if req == nil {
+		// the request had nothing to draw, like a chunk of an image
+		return nil
+	}
+
+	drawRequests <- req
+	return nil
+}
+
+func parseRequest(win *glfw.Window, line []byte) (drawRequest, error) {
 	var request request
 
 	err := json.Unmarshal(line, &request)
 
 	if err != nil {
-		return errors.WithMessage(err, "could not parse request")
+		return nil, errors.WithMessage(err, "could not parse request")
 	} else if request.Type == nil {
-		return errors.New("request is missing \"type\" field")
+		return nil, errors.New("request is missing \"type\" field")
 	}
 
-	switch *request.Type {
+	req, err := parseTypedRequest(win, *request.Type, line)
+
+	if err != nil || req == nil {
+		return req, err
+	} else if request.Layer != nil && request.Pane != nil {
+		return nil, errors.Errorf("%s request got both \"layer\" and \"pane\" field", *request.Type)
+	} else if request.Layer != nil {
+		return onLayerDrawRequest{layer: *request.Layer, req: req}, nil
+	} else if request.Pane != nil {
+		return onPaneDrawRequest{pane: *request.Pane, req: req}, nil
+	}
+
+	return req, nil
+}
+
+func parseTypedRequest(win *glfw.Window, reqType string, line []byte) (drawRequest, error) {
+	switch reqType {
 	case "char":
 		var req setCharRequest
 		err := json.Unmarshal(line, &req)
 
 		if err != nil {
-			return errors.WithMessage(err, "could not parse request")
+			return nil, errors.WithMessage(err, "could not parse request")
 		} else if req.Rune == nil {
-			return errors.New("char request is missing \"char\" field")
+			return nil, errors.New("char request is missing \"char\" field")
 		} else if req.Col == nil {
-			return errors.New("char request is missing \"col\" field")
+			return nil, errors.New("char request is missing \"col\" field")
 		} else if req.Row == nil {
-			return errors.New("char request is missing \"row\" field")
+			return nil, errors.New("char request is missing \"row\" field")
 		}
 
-		char, width := utf8.DecodeRuneInString(*req.Rune)
+		if *req.Rune == "" {
+			return nil, errors.New("char request was sent with empty char")
+		} else if !utf8.ValidString(*req.Rune) {
+			return nil, errors.New("char request was sent with invalid utf8")
+		} else if err := checkText("char", *req.Rune); err != nil {
+			return nil, err
+		}
 
-		if char == utf8.RuneError && width == 0 {
-			return errors.New("char request was sent with empty char")
-		} else if char == utf8.RuneError && width == 1 {
-			return errors.New("char request was sent with invalid utf8")
-		}
-
-		//col := *req.Col
-		//row := *req.Row
-		//
-		//textColor := color.RGBA{R: 255, G: 255, B: 255, A: 255}
-		//if req.Color != nil {
-		//	textColor = *req.Color
-		//	textColor.A = 255
-		//}
-		//
-		//bg := color.RGBA{R: 0, G: 0, B: 0, A: 255}
-		//if req.Background != nil {
-		//	bg = *req.Background
-		//	bg.A = 255
-		//}
-		//
-		//style := styleNormal
-		//if req.Style != nil {
-		//	if ok := styles[*req.Style]; !ok {
-		//		return errors.Errorf("char request got invalid style: %q", *req.Style)
-		//	}
-		//
-		//	style = *req.Style
-		//}
-
-		//drawRequests <- charDrawRequest{char: char, col: col, row: row, textColor: textColor, bg: bg, style: style}
-	//case "image":
-	//	var req imageRequest
-	//	err := json.Unmarshal(line, &req)
-	//
-	//	if err != nil {
-	//		return errors.WithMessage(err, "could not parse request")
-	//	} else if req.Col == nil {
-	//		return errors.New("image request is missing \"col\" field")
-	//	} else if req.Row == nil {
-	//		return errors.New("image request is missing \"row\" field")
-	//	} else if req.Image == nil {
-	//		return errors.New("image request is missing \"image\" field")
-	//	}
-	//
-	//	dec := base64.NewDecoder(base64.StdEncoding, strings.NewReader(*req.Image))
-	//	img, _, err := image.Decode(dec)
-	//
-	//	if err != nil {
-	//		return errors.WithMessage(err, "could not decode image")
-	//	}
-
-	//drawRequests <- imageDrawRequest{img: img, col: *req.Col, row: *req.Row}
+		template, err := req.template("char")
+
+		if err != nil {
+			return nil, err
+		}
+
+		cluster, _, width := firstCluster(*req.Rune)
+		template.setCluster(cluster, width)
+		return charDrawRequest{col: *req.Col, row: *req.Row, cell: template}, nil
+	case "text":
+		var req textRequest
+		err := json.Unmarshal(line, &req)
+
+		if err != nil {
+			return nil, errors.WithMessage(err, "could not parse request")
+		} else if req.Text == nil {
+			return nil, errors.New("text request is missing \"text\" field")
+		} else if req.Col == nil {
+			return nil, errors.New("text request is missing \"col\" field")
+		} else if req.Row == nil {
+			return nil, errors.New("text request is missing \"row\" field")
+		}
+
+		if !utf8.ValidString(*req.Text) {
+			return nil, errors.New("text request was sent with invalid utf8")
+		} else if err := checkText("text", *req.Text); err != nil {
+			return nil, err
+		}
+
+		template, err := req.template("text")
+
+		if err != nil {
+			return nil, err
+		}
+
+		wrap := req.Wrap != nil && *req.Wrap
+		return textDrawRequest{text: *req.Text, col: *req.Col, row: *req.Row, wrap: wrap, template: template}, nil
+	case "image":
+		var req imageRequest
+		err := json.Unmarshal(line, &req)
+
+		if err != nil {
+			return nil, errors.WithMessage(err, "could not parse request")
+		} else if req.Col == nil {
+			return nil, errors.New("image request is missing \"col\" field")
+		} else if req.Row == nil {
+			return nil, errors.New("image request is missing \"row\" field")
+		} else if req.Image == nil && req.ID == nil {
+			return nil, errors.New("image request is missing \"image\" or \"id\" field")
+		}
+
+		imageReq := imageDrawRequest{col: *req.Col, row: *req.Row, fit: fitContain}
+
+		if req.Image != nil {
+			img, err := decodeBase64Image(*req.Image, imageFormat{})
+
+			if err != nil {
+				return nil, err
+			}
+
+			// animations sent with the image request show their first frame
+			img.anim = nil
+			imageReq.image = img
+		} else {
+			imageReq.id = *req.ID
+		}
+
+		if req.Cols != nil {
+			if *req.Cols <= 0 {
+				return nil, errors.Errorf("image request got invalid cols %d", *req.Cols)
+			} else if *req.Cols > maxImageSize {
+				return nil, errors.Errorf("image request got cols %d, more than %d", *req.Cols, maxImageSize)
+			}
+
+			imageReq.cols = *req.Cols
+		}
+
+		if req.Rows != nil {
+			if *req.Rows <= 0 {
+				return nil, errors.Errorf("image request got invalid rows %d", *req.Rows)
+			} else if *req.Rows > maxImageSize {
+				return nil, errors.Errorf("image request got rows %d, more than %d", *req.Rows, maxImageSize)
+			}
+
+			imageReq.rows = *req.Rows
+		}
+
+		if req.Fit != nil {
+			if !fits[*req.Fit] {
+				return nil, errors.Errorf("image request got invalid fit: %q", *req.Fit)
+			}
+
+			imageReq.fit = *req.Fit
+		}
+
+		if req.ZOrder != nil {
+			above, ok := zOrders[*req.ZOrder]
+
+			if !ok {
+				return nil, errors.Errorf("image request got invalid zOrder: %q", *req.ZOrder)
+			}
+
+			imageReq.above = above
+		}
+
+		return imageReq, nil
+	case "uploadImage":
+		var req uploadImageRequest
+		err := json.Unmarshal(line, &req)
+
+		if err != nil {
+			return nil, errors.WithMessage(err, "could not parse request")
+		} else if req.ID == nil {
+			return nil, errors.New("uploadImage request is missing \"id\" field")
+		}
+
+		format, err := req.imageFormat("uploadImage")
+
+		if err != nil {
+			return nil, err
+		}
+
+		var img *uploadedImage
+
+		if req.Image != nil {
+			img, err = decodeBase64Image(*req.Image, format)
+		} else if req.Path != nil {
+			img, err = readImageFile(*req.Path, format)
+		} else if req.Shm != nil {
+			path, ok := shmPath(*req.Shm)
+
+			if !ok {
+				return nil, errors.Errorf("uploadImage request got invalid shm: %q", *req.Shm)
+			}
+
+			img, err = readImageFile(path, format)
+		} else {
+			return nil, errors.New("uploadImage request is missing \"image\", \"path\" or \"shm\" field")
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		return uploadImageDrawRequest{id: *req.ID, image: img}, nil
+	case "imageBegin":
+		var req imageBeginRequest
+		err := json.Unmarshal(line, &req)
+
+		if err != nil {
+			return nil, errors.WithMessage(err, "could not parse request")
+		} else if req.ID == nil {
+			return nil, errors.New("imageBegin request is missing \"id\" field")
+		}
+
+		format, err := req.imageFormat("imageBegin")
+
+		if err != nil {
+			return nil, err
+		}
+
+		dropTimedOutUploads()
+
+		// starting an upload again with the same id replaces the one before, dropping what was sent of it
+		pendingUploads[*req.ID] = &pendingUpload{format: format, updated: time.Now()}
+		return nil, nil
+	case "imageChunk":
+		var req imageChunkRequest
+		err := json.Unmarshal(line, &req)
+
+		if err != nil {
+			return nil, errors.WithMessage(err, "could not parse request")
+		} else if req.ID == nil {
+			return nil, errors.New("imageChunk request is missing \"id\" field")
+		} else if req.Data == nil {
+			return nil, errors.New("imageChunk request is missing \"data\" field")
+		}
+
+		pending, ok := pendingUploads[*req.ID]
+
+		if !ok {
+			return nil, errors.Errorf("imageChunk request got id %q without imageBegin", *req.ID)
+		}
+
+		chunk, err := base64.StdEncoding.DecodeString(*req.Data)
+
+		if err != nil {
+			delete(pendingUploads, *req.ID)
+			return nil, errors.WithMessage(err, "could not decode image chunk, the upload was dropped")
+		}
+
+		if pending.data.Len()+len(chunk) > pending.format.size() {
+			delete(pendingUploads, *req.ID)
+			return nil, errors.Errorf("imageChunk request got more than %d bytes for image %q, the upload was dropped",
+				pending.format.size(), *req.ID)
+		}
+
+		pending.data.Write(chunk)
+		pending.updated = time.Now()
+		return nil, nil
+	case "imageEnd":
+		var req imageEndRequest
+		err := json.Unmarshal(line, &req)
+
+		if err != nil {
+			return nil, errors.WithMessage(err, "could not parse request")
+		} else if req.ID == nil {
+			return nil, errors.New("imageEnd request is missing \"id\" field")
+		}
+
+		pending, ok := pendingUploads[*req.ID]
+
+		if !ok {
+			return nil, errors.Errorf("imageEnd request got id %q without imageBegin", *req.ID)
+		}
+
+		delete(pendingUploads, *req.ID)
+		img, err := pending.format.decode(pending.data.Bytes())
+
+		if err != nil {
+			return nil, err
+		}
+
+		return uploadImageDrawRequest{id: *req.ID, image: img}, nil
+	case "play", "pause", "seek":
+		var req animationRequest
+		err := json.Unmarshal(line, &req)
+
+		if err != nil {
+			return nil, errors.WithMessage(err, "could not parse request")
+		} else if req.ID == nil {
+			return nil, errors.Errorf("%s request is missing \"id\" field", reqType)
+		}
+
+		animReq := animationDrawRequest{action: reqType, id: *req.ID}
+
+		if reqType == "seek" {
+			if req.Frame == nil {
+				return nil, errors.New("seek request is missing \"frame\" field")
+			} else if *req.Frame < 0 {
+				return nil, errors.Errorf("seek request got invalid frame %d", *req.Frame)
+			}
+
+			animReq.frame = *req.Frame
+		}
+
+		return animReq, nil
+	case "deleteImage":
+		var req deleteImageRequest
+		err := json.Unmarshal(line, &req)
+
+		if err != nil {
+			return nil, errors.WithMessage(err, "could not parse request")
+		} else if req.ID == nil {
+			return nil, errors.New("deleteImage request is missing \"id\" field")
+		}
+
+		return deleteImageDrawRequest{id: *req.ID}, nil
+	case "fillRect":
+		var req fillRectRequest
+		err := json.Unmarshal(line, &req)
+
+		if err != nil {
+			return nil, errors.WithMessage(err, "could not parse request")
+		}
+
+		r, err := req.rect("fillRect")
+
+		if err != nil {
+			return nil, err
+		}
+
+		template, err := req.template("fillRect")
+
+		if err != nil {
+			return nil, err
+		}
+
+		if req.Rune != nil {
+			if *req.Rune == "" {
+				return nil, errors.New("fillRect request was sent with empty char")
+			} else if !utf8.ValidString(*req.Rune) {
+				return nil, errors.New("fillRect request was sent with invalid utf8")
+			}
+
+			cluster, _, width := firstCluster(*req.Rune)
+			template.setCluster(cluster, width)
+		}
+
+		return fillRectDrawRequest{rect: r, cell: template}, nil
+	case "copyRect", "moveRect":
+		var req copyRectRequest
+		err := json.Unmarshal(line, &req)
+
+		if err != nil {
+			return nil, errors.WithMessage(err, "could not parse request")
+		} else if req.ToCol == nil {
+			return nil, errors.Errorf("%s request is missing \"toCol\" field", reqType)
+		} else if req.ToRow == nil {
+			return nil, errors.Errorf("%s request is missing \"toRow\" field", reqType)
+		}
+
+		r, err := req.rect(reqType)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return copyRectDrawRequest{rect: r, to: image.Pt(*req.ToCol, *req.ToRow), move: reqType == "moveRect"}, nil
+	case "scroll":
+		var req scrollRequest
+		err := json.Unmarshal(line, &req)
+
+		if err != nil {
+			return nil, errors.WithMessage(err, "could not parse request")
+		} else if req.Lines == nil {
+			return nil, errors.New("scroll request is missing \"lines\" field")
+		}
+
+		r, err := req.rect("scroll")
+
+		if err != nil {
+			return nil, err
+		}
+
+		template, err := req.template("scroll")
+
+		if err != nil {
+			return nil, err
+		}
+
+		return scrollDrawRequest{rect: r, lines: *req.Lines, fill: template}, nil
 	case "clear":
-		//drawRequests <- clearDrawRequest{}
+		return clearDrawRequest{}, nil
 	case "title":
 		var req titleRequest
 		err := json.Unmarshal(line, &req)
 
 		if err != nil {
-			return errors.WithMessage(err, "could not parse request")
+			return nil, errors.WithMessage(err, "could not parse request")
 		} else if req.Title == nil {
-			return errors.New("title request is missing \"title\" field")
+			return nil, errors.New("title request is missing \"title\" field")
+		}
+
+		return titleDrawRequest{win: win, title: *req.Title}, nil
+	case "theme":
+		var req themeRequest
+		err := json.Unmarshal(line, &req)
+
+		if err != nil {
+			return nil, errors.WithMessage(err, "could not parse request")
 		}
 
-		win.SetTitle(*req.Title)
+		err = req.validate()
+
+		if err != nil {
+			return nil, err
+		}
+
+		return themeDrawRequest{req: req}, nil
+	case "font":
+		var req fontRequest
+		err := json.Unmarshal(line, &req)
+
+		if err != nil {
+			return nil, errors.WithMessage(err, "could not parse request")
+		}
+
+		return req.drawRequest(win)
+	case "glyphInfo":
+		var req glyphInfoRequest
+		err := json.Unmarshal(line, &req)
+
+		if err != nil {
+			return nil, errors.WithMessage(err, "could not parse request")
+		} else if req.Rune == nil {
+			return nil, errors.New("glyphInfo request is missing \"char\" field")
+		}
+
+		char, width := utf8.DecodeRuneInString(*req.Rune)
+
+		if char == utf8.RuneError && width == 0 {
+			return nil, errors.New("glyphInfo request was sent with empty char")
+		} else if char == utf8.RuneError && width == 1 {
+			return nil, errors.New("glyphInfo request was sent with invalid utf8")
+		}
+
+		return glyphInfoDrawRequest{char: char}, nil
+	case "stats":
+		return statsDrawRequest{}, nil
 	case "close":
-		win.SetShouldClose(true)
+		return closeDrawRequest{win: win}, nil
+	case "layer":
+		var req layerRequest
+		err := json.Unmarshal(line, &req)
+
+		if err != nil {
+			return nil, errors.WithMessage(err, "could not parse request")
+		}
+
+		err = req.validate()
+
+		if err != nil {
+			return nil, err
+		}
+
+		return setLayerDrawRequest{req: req}, nil
+	case "deleteLayer":
+		var req deleteLayerRequest
+		err := json.Unmarshal(line, &req)
+
+		if err != nil {
+			return nil, errors.WithMessage(err, "could not parse request")
+		} else if req.Name == nil {
+			return nil, errors.New("deleteLayer request is missing \"name\" field")
+		}
+
+		return deleteLayerDrawRequest{name: *req.Name}, nil
+	case "createPane", "setPane":
+		var req paneRequest
+		err := json.Unmarshal(line, &req)
+
+		if err != nil {
+			return nil, errors.WithMessage(err, "could not parse request")
+		}
+
+		create := reqType == "createPane"
+		err = req.validate(reqType, create)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return setPaneDrawRequest{req: req, create: create}, nil
+	case "deletePane":
+		var req deletePaneRequest
+		err := json.Unmarshal(line, &req)
+
+		if err != nil {
+			return nil, errors.WithMessage(err, "could not parse request")
+		} else if req.ID == nil {
+			return nil, errors.New("deletePane request is missing \"id\" field")
+		}
+
+		return deletePaneDrawRequest{id: *req.ID}, nil
+	case "batch":
+		var req batchRequest
+		err := json.Unmarshal(line, &req)
+
+		if err != nil {
+			return nil, errors.WithMessage(err, "could not parse request")
+		} else if req.Requests == nil {
+			return nil, errors.New("batch request is missing \"requests\" field")
+		}
+
+		batch := batchDrawRequest{}
+		failed := false
+
+		for i, subLine := range req.Requests {
+			var sub request
+
+			if json.Unmarshal(subLine, &sub) == nil && sub.Type != nil && unbatchedRequests[*sub.Type] {
+				sendIndexedError(i, errors.Errorf("%s request can not be sent in a batch", *sub.Type))
+				failed = true
+				continue
+			}
+
+			subReq, err := parseRequest(win, subLine)
+
+			if err != nil {
+				sendIndexedError(i, err)
+				failed = true
+				continue
+			}
+
+			if subReq != nil {
+				batch = append(batch, subReq)
+			}
+		}
+
+		if failed {
+			return nil, errors.New("batch request was dropped since some of its requests failed")
+		}
+
+		return batch, nil
 	default:
-		return errors.Errorf("unknown request type %q", request.Type)
+		return nil, errors.Errorf("unknown request type %q", reqType)
 	}
-
-	return nil
 }
 
 type request struct {
 	Type *string `json:"type"`
+
+	// Layer & Pane apply the request to a layer or a pane instead of the screen
+	Layer *string `json:"layer"`
+	Pane  *string `json:"pane"`
+}
+
+// cellAttributes are the fields shared by all requests that draw characters
+type cellAttributes struct {
+	Color          *requestColor `json:"color"`
+	Background     *requestColor `json:"background"`
+	Style          *string       `json:"style"`
+	Bold           *bool         `json:"bold"`
+	Italic         *bool         `json:"italic"`
+	Underline      *string       `json:"underline"`
+	UnderlineColor *requestColor `json:"underlineColor"`
+	Strikethrough  *bool         `json:"strikethrough"`
+	Dim            *bool         `json:"dim"`
+	Reverse        *bool         `json:"reverse"`
+	Blink          *bool         `json:"blink"`
+	Direction      *string       `json:"direction"`
+}
+
+// template returns an empty cell with the attributes applied, reqType is used in error messages
+func (attrs cellAttributes) template(reqType string) (cell, error) {
+	c := emptyCell()
+
+	if attrs.Color != nil {
+		c.textColor = cellColor(*attrs.Color)
+	}
+
+	if attrs.Background != nil {
+		c.bg = cellColor(*attrs.Background)
+	}
+
+	if attrs.Style != nil {
+		style, ok := styles[*attrs.Style]
+
+		if !ok {
+			return cell{}, errors.Errorf("%s request got invalid style: %q", reqType, *attrs.Style)
+		}
+
+		c.attrs |= style
+	}
+
+	if attrs.Underline != nil {
+		underline, ok := underlines[*attrs.Underline]
+
+		if !ok {
+			return cell{}, errors.Errorf("%s request got invalid underline: %q", reqType, *attrs.Underline)
+		}
+
+		c.attrs |= underline
+	}
+
+	if attrs.Direction != nil {
+		direction, ok := directions[*attrs.Direction]
+
+		if !ok {
+			return cell{}, errors.Errorf("%s request got invalid direction: %q", reqType, *attrs.Direction)
+		}
+
+		c.attrs |= direction
+	}
+
+	if attrs.UnderlineColor != nil {
+		underlineColor := cellColor(*attrs.UnderlineColor)
+		c.underlineColor = &underlineColor
+	}
+
+	flags := []struct {
+		set  *bool
+		attr attributes
+	}{
+		{attrs.Bold, attrBold},
+		{attrs.Italic, attrItalic},
+		{attrs.Strikethrough, attrStrikethrough},
+		{attrs.Dim, attrDim},
+		{attrs.Reverse, attrReverse},
+		{attrs.Blink, attrBlink},
+	}
+
+	for _, flag := range flags {
+		if flag.set != nil && *flag.set {
+			c.attrs |= flag.attr
+		}
+	}
+
+	return c, nil
 }
 
 type setCharRequest struct {
-	Rune       *string     `json:"char"`
-	Col        *int        `json:"col"`
-	Row        *int        `json:"row"`
-	Color      *color.RGBA `json:"color"`
-	Background *color.RGBA `json:"background"`
-	Style      *string     `json:"style"`
+	Rune *string `json:"char"`
+	Col  *int    `json:"col"`
+	Row  *int    `json:"row"`
+	cellAttributes
+}
+
+type textRequest struct {
+	Text *string `json:"text"`
+	Col  *int    `json:"col"`
+	Row  *int    `json:"row"`
+	Wrap *bool   `json:"wrap"`
+	cellAttributes
+}
+
+// checkText refuses control characters like newlines and tabs, they have no glyph to draw in a cell
+func checkText(reqType, text string) error {
+	if i := strings.IndexFunc(text, unicode.IsControl); i >= 0 {
+		char, _ := utf8.DecodeRuneInString(text[i:])
+		return errors.Errorf("%s request got invalid character: %q", reqType, string(char))
+	}
+
+	return nil
+}
+
+// cellRect is the area of the grid that rectangle requests work on
+type cellRect struct {
+	Col  *int `json:"col"`
+	Row  *int `json:"row"`
+	Cols *int `json:"cols"`
+	Rows *int `json:"rows"`
+}
+
+// rect returns the area in cols & rows, reqType is used in error messages
+func (r cellRect) rect(reqType string) (image.Rectangle, error) {
+	if r.Col == nil {
+		return image.Rectangle{}, errors.Errorf("%s request is missing \"col\" field", reqType)
+	} else if r.Row == nil {
+		return image.Rectangle{}, errors.Errorf("%s request is missing \"row\" field", reqType)
+	} else if r.Cols == nil {
+		return image.Rectangle{}, errors.Errorf("%s request is missing \"cols\" field", reqType)
+	} else if r.Rows == nil {
+		return image.Rectangle{}, errors.Errorf("%s request is missing \"rows\" field", reqType)
+	} else if *r.Cols < 0 || *r.Rows < 0 {
+		return image.Rectangle{}, errors.Errorf("%s request got negative size", reqType)
+	} else if *r.Col > math.MaxInt-*r.Cols || *r.Row > math.MaxInt-*r.Rows {
+		return image.Rectangle{}, errors.Errorf("%s request got a rectangle out of range", reqType)
+	}
+
+	// the rectangle can be larger than the grid, it is clipped to the grid it is applied to
+	return image.Rect(*r.Col, *r.Row, *r.Col+*r.Cols, *r.Row+*r.Rows), nil
+}
+
+type fillRectRequest struct {
+	Rune *string `json:"char"`
+	cellRect
+	cellAttributes
+}
+
+type copyRectRequest struct {
+	ToCol *int `json:"toCol"`
+	ToRow *int `json:"toRow"`
+	cellRect
+}
+
+type scrollRequest struct {
+	Lines *int `json:"lines"`
+	cellRect
+	cellAttributes
 }
 
 type imageRequest struct {
+	Image  *string `json:"image"`
+	ID     *string `json:"id"`
+	Col    *int    `json:"col"`
+	Row    *int    `json:"row"`
+	Cols   *int    `json:"cols"`
+	Rows   *int    `json:"rows"`
+	Fit    *string `json:"fit"`
+	ZOrder *string `json:"zOrder"`
+}
+
+type uploadImageRequest struct {
+	ID    *string `json:"id"`
 	Image *string `json:"image"`
-	Col   *int    `json:"col"`
-	Row   *int    `json:"row"`
+	Path  *string `json:"path"`
+	Shm   *string `json:"shm"`
+	imageFormatRequest
+}
+
+type imageBeginRequest struct {
+	ID *string `json:"id"`
+	imageFormatRequest
+}
+
+type imageChunkRequest struct {
+	ID   *string `json:"id"`
+	Data *string `json:"data"`
+}
+
+type imageEndRequest struct {
+	ID *string `json:"id"`
+}
+
+// imageFormatRequest are the fields of the requests uploading an image that tell how its data is decoded
+type imageFormatRequest struct {
+	Format *string `json:"format"`
+	Width  *int    `json:"width"`
+	Height *int    `json:"height"`
+}
+
+// imageFormat validates the fields, reqType is used in error messages
+func (req imageFormatRequest) imageFormat(reqType string) (imageFormat, error) {
+	if req.Format == nil || *req.Format == "encoded" {
+		return imageFormat{}, nil
+	} else if *req.Format != "rgba" {
+		return imageFormat{}, errors.Errorf("%s request got invalid format: %q", reqType, *req.Format)
+	}
+
+	if req.Width == nil {
+		return imageFormat{}, errors.Errorf("%s request is missing \"width\" field", reqType)
+	} else if req.Height == nil {
+		return imageFormat{}, errors.Errorf("%s request is missing \"height\" field", reqType)
+	} else if *req.Width <= 0 {
+		return imageFormat{}, errors.Errorf("%s request got invalid width %d", reqType, *req.Width)
+	} else if *req.Height <= 0 {
+		return imageFormat{}, errors.Errorf("%s request got invalid height %d", reqType, *req.Height)
+	} else if *req.Width > maxImageSize || *req.Height > maxImageSize {
+		return imageFormat{}, errors.Errorf("%s request got size %d x %d, more than %d", reqType, *req.Width, *req.Height,
+			maxImageSize)
+	} else if !fitsPixels(*req.Width, *req.Height, 1) {
+		return imageFormat{}, errors.Errorf("%s request got size %d x %d, more than %d pixels", reqType, *req.Width,
+			*req.Height, maxImagePixels)
+	}
+
+	return imageFormat{raw: true, width: *req.Width, height: *req.Height}, nil
+}
+
+type animationRequest struct {
+	ID    *string `json:"id"`
+	Frame *int    `json:"frame"`
+}
+
+type deleteImageRequest struct {
+	ID *string `json:"id"`
+}
+
+type layerRequest struct {
+	Name    *string  `json:"name"`
+	Col     *int     `json:"col"`
+	Row     *int     `json:"row"`
+	Cols    *int     `json:"cols"`
+	Rows    *int     `json:"rows"`
+	Visible *bool    `json:"visible"`
+	Opacity *float64 `json:"opacity"`
+	ZIndex  *int     `json:"zIndex"`
+}
+
+func (req layerRequest) validate() error {
+	if req.Name == nil {
+		return errors.New("layer request is missing \"name\" field")
+	} else if req.Cols != nil && *req.Cols <= 0 {
+		return errors.Errorf("layer request got invalid cols %d", *req.Cols)
+	} else if req.Rows != nil && *req.Rows <= 0 {
+		return errors.Errorf("layer request got invalid rows %d", *req.Rows)
+	} else if req.Cols != nil && req.Rows != nil && !validGridSize(*req.Cols, *req.Rows) {
+		return errors.Errorf("layer request got size %d x %d, more than %d cells", *req.Cols, *req.Rows, maxGridCells)
+	} else if req.Opacity != nil && (*req.Opacity < 0 || *req.Opacity > 1) {
+		return errors.Errorf("layer request got invalid opacity %g", *req.Opacity)
+	}
+
+	return nil
+}
+
+type deleteLayerRequest struct {
+	Name *string `json:"name"`
+}
+
+type paneRequest struct {
+	ID          *string `json:"id"`
+	Col         *int    `json:"col"`
+	Row         *int    `json:"row"`
+	Cols        *int    `json:"cols"`
+	Rows        *int    `json:"rows"`
+	ContentCols *int    `json:"contentCols"`
+	ContentRows *int    `json:"contentRows"`
+	ScrollCol   *int    `json:"scrollCol"`
+	ScrollRow   *int    `json:"scrollRow"`
+}
+
+// validate checks the fields, reqType is used in error messages. The box of the pane is needed to create it
+func (req paneRequest) validate(reqType string, create bool) error {
+	if req.ID == nil {
+		return errors.Errorf("%s request is missing \"id\" field", reqType)
+	}
+
+	if create {
+		if req.Col == nil {
+			return errors.Errorf("%s request is missing \"col\" field", reqType)
+		} else if req.Row == nil {
+			return errors.Errorf("%s request is missing \"row\" field", reqType)
+		} else if req.Cols == nil {
+			return errors.Errorf("%s request is missing \"cols\" field", reqType)
+		} else if req.Rows == nil {
+			return errors.Errorf("%s request is missing \"rows\" field", reqType)
+		}
+	}
+
+	sizes := []struct {
+		name  string
+		value *int
+	}{
+		{"cols", req.Cols},
+		{"rows", req.Rows},
+		{"contentCols", req.ContentCols},
+		{"contentRows", req.ContentRows},
+	}
+
+	for _, size := range sizes {
+		if size.value != nil && *size.value <= 0 {
+			return errors.Errorf("%s request got invalid %s %d", reqType, size.name, *size.value)
+		}
+	}
+
+	if req.Cols != nil && req.Rows != nil && !validGridSize(*req.Cols, *req.Rows) {
+		return errors.Errorf("%s request got size %d x %d, more than %d cells", reqType, *req.Cols, *req.Rows, maxGridCells)
+	} else if req.ContentCols != nil && req.ContentRows != nil && !validGridSize(*req.ContentCols, *req.ContentRows) {
+		return errors.Errorf("%s request got content size %d x %d, more than %d cells", reqType, *req.ContentCols,
+			*req.ContentRows, maxGridCells)
+	}
+
+	if req.ScrollCol != nil && *req.ScrollCol < 0 {
+		return errors.Errorf("%s request got invalid scrollCol %d", reqType, *req.ScrollCol)
+	} else if req.ScrollRow != nil && *req.ScrollRow < 0 {
+		return errors.Errorf("%s request got invalid scrollRow %d", reqType, *req.ScrollRow)
+	}
+
+	return nil
+}
+
+type deletePaneRequest struct {
+	ID *string `json:"id"`
+}
+
+// unbatchedRequests are the requests refused in a batch. Uploads are decoded when parsed, and a large image would
+// hold up the whole batch. Chunked uploads are also kept when parsed, so they could not be dropped with the batch
+var unbatchedRequests = map[string]bool{
+	"uploadImage": true,
+	"imageBegin":  true,
+	"imageChunk":  true,
+	"imageEnd":    true,
+}
+
+type batchRequest struct {
+	Requests []json.RawMessage `json:"requests"`
+}
+
+type glyphInfoRequest struct {
+	Rune *string `json:"char"`
 }
 
 type titleRequest struct {
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"image"
+	"math"
+	"os"
+	"testing"
+)
+
+// captureErrors runs f and returns the error events it sent
+func captureErrors(t *testing.T, f func()) []errorEvent {
+	read, write, err := os.Pipe()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stdout := os.Stdout
+	os.Stdout = write
+	f()
+	os.Stdout = stdout
+	write.Close()
+
+	var events []errorEvent
+	scanner := bufio.NewScanner(read)
+
+	for scanner.Scan() {
+		var event errorEvent
+
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatal(err)
+		}
+
+		events = append(events, event)
+	}
+
+	return events
+}
+
+func TestBatchErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		batch   string
+		indexes []int
+	}{
+		{"valid", `{"type": "batch", "requests": [{"type": "clear"}, {"type": "char", "char": "a", "col": 0, "row": 0}]}`, nil},
+		{"invalid requests", `{"type": "batch", "requests": [{"type": "char", "char": "a"}, {"type": "clear"}, {"type": "nope"}]}`, []int{0, 2}},
+		{"upload", `{"type": "batch", "requests": [{"type": "clear"}, {"type": "imageBegin", "id": "a", "format": "png"}]}`, []int{1}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var err error
+
+			events := captureErrors(t, func() {
+				_, err = parseRequest(nil, []byte(test.batch))
+			})
+
+			if (err != nil) != (test.indexes != nil) {
+				t.Fatalf("got error %v, want one: %t", err, test.indexes != nil)
+			} else if len(events) != len(test.indexes) {
+				t.Fatalf("got %d indexed errors, want %d", len(events), len(test.indexes))
+			}
+
+			for i, event := range events {
+				if event.Index == nil || *event.Index != test.indexes[i] {
+					t.Errorf("error %q has index %v, want %d", event.Error, event.Index, test.indexes[i])
+				}
+			}
+		})
+	}
+
+	if len(pendingUploads) != 0 {
+		t.Errorf("batch started %d uploads", len(pendingUploads))
+	}
+}
+
+func TestCheckText(t *testing.T) {
+	tests := []struct {
+		text string
+		ok   bool
+	}{
+		{"", true},
+		{"abc def", true},
+		{"e\u0301 \U0001F44D\u200D", true},
+		{"a\nb", false},
+		{"\t", false},
+		{"\x00", false},
+		{"\x7f", false},
+		{"\u0085", false},
+	}
+
+	for _, test := range tests {
+		if err := checkText("text", test.text); (err == nil) != test.ok {
+			t.Errorf("checkText(%q) = %v, want ok: %t", test.text, err, test.ok)
+		}
+	}
+}
+
+func TestCellRect(t *testing.T) {
+	n := func(i int) *int { return &i }
+
+	tests := []struct {
+		name string
+		r    cellRect
+		want image.Rectangle
+		ok   bool
+	}{
+		{"inside", cellRect{n(1), n(2), n(3), n(4)}, image.Rect(1, 2, 4, 6), true},
+		{"empty", cellRect{n(1), n(2), n(0), n(0)}, image.Rect(1, 2, 1, 2), true},
+		{"larger than any grid", cellRect{n(-5), n(0), n(1 << 30), n(3)}, image.Rect(-5, 0, 1<<30-5, 3), true},
+		{"missing col", cellRect{nil, n(2), n(3), n(4)}, image.Rectangle{}, false},
+		{"missing rows", cellRect{n(1), n(2), n(3), nil}, image.Rectangle{}, false},
+		{"negative size", cellRect{n(1), n(2), n(-3), n(4)}, image.Rectangle{}, false},
+		{"overflowing", cellRect{n(1), n(2), n(math.MaxInt), n(4)}, image.Rectangle{}, false},
+		{"overflowing rows", cellRect{n(1), n(math.MaxInt - 1), n(1), n(2)}, image.Rectangle{}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := test.r.rect("fillRect")
+
+			if (err == nil) != test.ok {
+				t.Fatalf("got error %v, want ok: %t", err, test.ok)
+			} else if got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
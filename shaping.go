@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+
+	"github.com/go-text/typesetting/di"
+	gotext "github.com/go-text/typesetting/font"
+	ot "github.com/go-text/typesetting/font/opentype"
+	"github.com/go-text/typesetting/language"
+	"github.com/go-text/typesetting/shaping"
+	"golang.org/x/image/math/fixed"
+	"golang.org/x/image/vector"
+)
+
+var (
+	// shapingEnabled turns on shaping of runs of cells, set with the -shaping flag or the font request.
+	// Only touched from the main thread
+	shapingEnabled bool
+
+	// the faces of the current font for the shaper, set when loading fonts.
+	// A face is nil if the font could not be read by the shaper, its cells are then drawn without shaping
+	shapingFaces [faceCount]*gotext.Face
+
+	shaper shaping.HarfbuzzShaper
+)
+
+// glyphPiece is a shaped glyph drawn in a cell, x being the offset of the glyph origin from the left of the cell
+// and y from the baseline. Glyphs covering several cells are drawn in each of them
+type glyphPiece struct {
+	glyph gotext.GID
+	x, y  fixed.Int26_6
+}
+
+// shapedCell is what the shaping stage draws in a cell, pieces being the glyph pieces encoded by encodePieces.
+// Cells that are not shaped are drawn one character at a time
+type shapedCell struct {
+	shaped bool
+	pieces string
+}
+
+// encodePieces turns pieces into a string, so it can be used as the key of the cell in the glyph atlas
+func encodePieces(pieces []glyphPiece) string {
+	buf := make([]byte, 0, len(pieces)*12)
+
+	for _, piece := range pieces {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(piece.glyph))
+		buf = binary.BigEndian.AppendUint32(buf, uint32(piece.x))
+		buf = binary.BigEndian.AppendUint32(buf, uint32(piece.y))
+	}
+
+	return string(buf)
+}
+
+func decodePieces(encoded string) []glyphPiece {
+	pieces := make([]glyphPiece, 0, len(encoded)/12)
+
+	for i := 0; i+12 <= len(encoded); i += 12 {
+		buf := []byte(encoded[i : i+12])
+		pieces = append(pieces, glyphPiece{
+			glyph: gotext.GID(binary.BigEndian.Uint32(buf)),
+			x:     fixed.Int26_6(int32(binary.BigEndian.Uint32(buf[4:]))),
+			y:     fixed.Int26_6(int32(binary.BigEndian.Uint32(buf[8:]))),
+		})
+	}
+
+	return pieces
+}
+
+func loadShapingFaces(faces fontFiles) [faceCount]*gotext.Face {
+	var loaded [faceCount]*gotext.Face
+
+	for face, data := range faces {
+		if data == nil {
+			continue
+		}
+
+		parsed, err := gotext.ParseTTF(bytes.NewReader(data))
+
+		if err == nil {
+			loaded[face] = parsed
+		}
+	}
+
+	return loaded
+}
+
+// shapingFace picks the face for the shaper the same way fontFace does
+func shapingFace(attrs attributes) (face *gotext.Face, slant bool) {
+	switch attrs & attrFace {
+	case attrBold:
+		return shapingFaces[faceBold], false
+	case attrItalic:
+		if fontItalic != nil {
+			return shapingFaces[faceItalic], false
+		}
+
+		return shapingFaces[faceRegular], true
+	case attrBold | attrItalic:
+		if fontBoldItalic != nil {
+			return shapingFaces[faceBoldItalic], false
+		}
+
+		return shapingFaces[faceBold], true
+	default:
+		return shapingFaces[faceRegular], false
+	}
+}
+
+// shapable reports if a cell can be part of a shaped run. Wide characters, characters drawn procedurally,
+// from a fallback font or with the emoji font, and images are drawn one at a time
+func shapable(c cell) bool {
+	return c.img == nil && c.attrs&attrWidth == 0 && !procedural(c.char) && resolveFallback(c.char) < 0 &&
+		!(emojiFont != nil && coloredCluster(c.char, c.combining, false))
+}
+
+// shapeRow splits a row into runs of cells with the same face and direction, and shapes each run.
+// Rows reordered for right to left text are shaped in visual order, the result is indexed by visual column
+func shapeRow(cells []cell, layout *bidiLayout) []shapedCell {
+	shaped := make([]shapedCell, len(cells))
+	rtl := make([]bool, len(cells))
+
+	if layout != nil {
+		visual := make([]cell, len(cells))
+
+		for col, logical := range layout.visual {
+			visual[col] = cells[logical]
+			rtl[col] = layout.levels[logical]%2 == 1
+		}
+
+		cells = visual
+	}
+
+	for col := 0; col < len(cells); {
+		if !shapable(cells[col]) {
+			col++
+			continue
+		}
+
+		end := col + 1
+
+		for end < len(cells) && shapable(cells[end]) && cells[end].attrs&attrFace == cells[col].attrs&attrFace &&
+			rtl[end] == rtl[col] {
+			end++
+		}
+
+		shapeRun(cells[col:end], rtl[col], shaped[col:end])
+		col = end
+	}
+
+	return shaped
+}
+
+// shapeRun shapes the text of a run of cells, placing each glyph cluster at the leftmost cell its characters are in.
+// The cells of right to left runs are in visual order, so their text is read from the last cell to the first
+func shapeRun(cells []cell, rtl bool, shaped []shapedCell) {
+	face, _ := shapingFace(cells[0].attrs)
+
+	if face == nil {
+		return
+	}
+
+	var text []rune
+	var runeCells []int
+	blank := true
+
+	for j := range cells {
+		i := j
+
+		if rtl {
+			i = len(cells) - 1 - j
+		}
+
+		for _, char := range cells[i].text() {
+			text = append(text, char)
+			runeCells = append(runeCells, i)
+		}
+
+		blank = blank && cells[i].char == ' ' && cells[i].combining == ""
+	}
+
+	if blank {
+		return
+	}
+
+	direction := di.DirectionLTR
+
+	if rtl {
+		direction = di.DirectionRTL
+	}
+
+	output := shaper.Shape(shaping.Input{
+		Text:      text,
+		RunStart:  0,
+		RunEnd:    len(text),
+		Direction: direction,
+		Face:      face,
+		Size:      fixed.Int26_6(fontSize * 64),
+		Script:    runScript(text),
+	})
+
+	// a cluster covers the characters from its index up to the next cluster
+	homes := make([]int, len(text))
+	starts := make([]bool, len(text))
+
+	for _, glyph := range output.Glyphs {
+		starts[glyph.ClusterIndex] = true
+	}
+
+	cluster := 0
+
+	for i := range text {
+		if starts[i] {
+			cluster = i
+			homes[cluster] = runeCells[i]
+		} else if runeCells[i] < homes[cluster] {
+			homes[cluster] = runeCells[i]
+		}
+	}
+
+	pieces := make([][]glyphPiece, len(cells))
+	var pen, clusterPen fixed.Int26_6
+	cluster = -1
+
+	for _, glyph := range output.Glyphs {
+		if glyph.ClusterIndex != cluster {
+			cluster = glyph.ClusterIndex
+			clusterPen = pen
+		}
+
+		x := fixed.I(homes[cluster]*colWidth) + pen - clusterPen + glyph.XOffset
+		pen += glyph.XAdvance
+
+		// glyphs without ink, like spaces, are left out
+		if glyph.Width <= 0 {
+			continue
+		}
+
+		first := floorDiv((x + glyph.XBearing).Floor(), colWidth)
+		last := floorDiv((x+glyph.XBearing+glyph.Width).Ceil()-1, colWidth)
+
+		for i := first; i <= last; i++ {
+			if i >= 0 && i < len(cells) {
+				pieces[i] = append(pieces[i], glyphPiece{glyph: glyph.GlyphID, x: x - fixed.I(i*colWidth), y: glyph.YOffset})
+			}
+		}
+	}
+
+	for i := range shaped {
+		shaped[i] = shapedCell{shaped: true, pieces: encodePieces(pieces[i])}
+	}
+}
+
+// runScript returns the script of the first character in text that belongs to one
+func runScript(text []rune) language.Script {
+	for _, char := range text {
+		if script := language.LookupScript(char); script != language.Common && script != language.Inherited {
+			return script
+		}
+	}
+
+	return language.Latin
+}
+
+func floorDiv(a, b int) int {
+	if a < 0 {
+		return -((-a + b - 1) / b)
+	}
+
+	return a / b
+}
+
+// rasterizePieces draws the shaped glyph pieces of a cell
+func rasterizePieces(pieces []glyphPiece, attrs attributes) *image.Alpha {
+	img := image.NewAlpha(image.Rect(0, 0, colWidth, rowHeight))
+	face, slanted := shapingFace(attrs)
+	scale := float32(fontSize) / float32(face.Upem())
+	z := vector.NewRasterizer(colWidth, rowHeight)
+
+	for _, piece := range pieces {
+		outline, ok := face.GlyphData(piece.glyph).(gotext.GlyphOutline)
+
+		if !ok {
+			continue
+		}
+
+		z.Reset(colWidth, rowHeight)
+		drawOutline(z, outline, float32(piece.x)/64, float32(baseline)-float32(piece.y)/64, scale)
+		z.Draw(img, img.Rect, image.Opaque, image.Point{})
+	}
+
+	if slanted {
+		img = slantGlyph(img, baseline)
+	}
+
+	return img
+}
+
+// drawOutline adds the outline of a glyph, in font units, to the rasterizer with its origin at x, y
+func drawOutline(z *vector.Rasterizer, outline gotext.GlyphOutline, x, y, scale float32) {
+	point := func(p gotext.SegmentPoint) (float32, float32) {
+		return x + p.X*scale, y - p.Y*scale
+	}
+
+	for i, segment := range outline.Segments {
+		switch segment.Op {
+		case ot.SegmentOpMoveTo:
+			if i > 0 {
+				z.ClosePath()
+			}
+
+			z.MoveTo(point(segment.Args[0]))
+		case ot.SegmentOpLineTo:
+			z.LineTo(point(segment.Args[0]))
+		case ot.SegmentOpQuadTo:
+			x1, y1 := point(segment.Args[0])
+			x2, y2 := point(segment.Args[1])
+			z.QuadTo(x1, y1, x2, y2)
+		case ot.SegmentOpCubeTo:
+			x1, y1 := point(segment.Args[0])
+			x2, y2 := point(segment.Args[1])
+			x3, y3 := point(segment.Args[2])
+			z.CubeTo(x1, y1, x2, y2, x3, y3)
+		}
+	}
+
+	if len(outline.Segments) > 0 {
+		z.ClosePath()
+	}
+}
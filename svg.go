@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"math"
+
+	"github.com/pkg/errors"
+	"github.com/srwiley/oksvg"
+	"github.com/srwiley/rasterx"
+)
+
+// isSVG tells if the data starts with an svg element, after a byte order mark and any xml declaration, processing
+// instructions, doctype, comments and white space. Binary images never start like that
+func isSVG(data []byte) bool {
+	rest := bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+
+	// skip drops rest up to the end of the first end in it, false if there is none
+	skip := func(end string) bool {
+		i := bytes.Index(rest, []byte(end))
+
+		if i < 0 {
+			return false
+		}
+
+		rest = rest[i+len(end):]
+		return true
+	}
+
+	for {
+		rest = bytes.TrimLeft(rest, " \t\r\n")
+
+		switch {
+		case bytes.HasPrefix(rest, []byte("<svg")):
+			return len(rest) > 4 && bytes.IndexByte([]byte(" \t\r\n/>"), rest[4]) >= 0
+		case bytes.HasPrefix(rest, []byte("<?")):
+			if !skip("?>") {
+				return false
+			}
+		case bytes.HasPrefix(rest, []byte("<!--")):
+			if !skip("-->") {
+				return false
+			}
+		case bytes.HasPrefix(rest, []byte("<!")):
+			// a doctype can have an internal subset in brackets, declaring entities
+			end := ">"
+
+			if bracket := bytes.IndexByte(rest, '['); bracket >= 0 && bracket < bytes.IndexByte(rest, '>') {
+				end = "]>"
+			}
+
+			if !skip(end) {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+}
+
+func decodeSVG(data []byte) (*oksvg.SvgIcon, error) {
+	icon, err := oksvg.ReadIconStream(bytes.NewReader(data), oksvg.IgnoreErrorMode)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !(icon.ViewBox.W > 0 && icon.ViewBox.H > 0) {
+		return nil, errors.New("svg image has no size")
+	} else if icon.ViewBox.W > maxImageSize || icon.ViewBox.H > maxImageSize {
+		return nil, errors.Errorf("svg image of %g x %g is larger than %d pixels", icon.ViewBox.W, icon.ViewBox.H,
+			maxImageSize)
+	}
+
+	return icon, nil
+}
+
+// vectorPlacement is an svg image placed in a box of cols x rows. It is the image of the cells showing it, and is
+// drawn again at the size of the box each time the size of the cells changes, so it stays sharp
+type vectorPlacement struct {
+	icon *oksvg.SvgIcon
+	cols int
+	rows int
+	fit  string
+	img  *image.NRGBA
+}
+
+func (p *vectorPlacement) size() image.Point {
+	return image.Pt(p.cols*colWidth, p.rows*rowHeight)
+}
+
+// drawnSize returns the size the image is drawn at, the size of the box scaled down to fit maxImageSize and
+// maxImagePixels when the cells grew after placing it. The renderer scales it up again to cover the box
+func (p *vectorPlacement) drawnSize() image.Point {
+	size := p.size()
+	scale := math.Min(1, math.Min(maxImageSize/float64(size.X), maxImageSize/float64(size.Y)))
+
+	if pixels := float64(size.X) * float64(size.Y) * scale * scale; pixels > maxImagePixels {
+		scale *= math.Sqrt(maxImagePixels / pixels)
+	}
+
+	return image.Pt(int(math.Max(1, float64(size.X)*scale)), int(math.Max(1, float64(size.Y)*scale)))
+}
+
+func (p *vectorPlacement) current() image.Image {
+	if size := p.drawnSize(); p.img == nil || p.img.Rect.Size() != size {
+		p.img = image.NewNRGBA(image.Rectangle{Max: size})
+		x, y, w, h := fitRect(p.icon.ViewBox.W, p.icon.ViewBox.H, size, p.fit)
+		p.icon.SetTarget(x, y, w, h)
+
+		scanner := rasterx.NewScannerGV(size.X, size.Y, p.img, p.img.Rect)
+		p.icon.Draw(rasterx.NewDasher(size.X, size.Y, scanner), 1)
+	}
+
+	return p.img
+}
+
+// version changes with the size of the box, which is when the image is drawn again
+func (p *vectorPlacement) version() int {
+	size := p.size()
+	return size.X<<16 | size.Y
+}
+
+func (p *vectorPlacement) ColorModel() color.Model {
+	return color.NRGBAModel
+}
+
+func (p *vectorPlacement) Bounds() image.Rectangle {
+	return image.Rectangle{Max: p.size()}
+}
+
+func (p *vectorPlacement) At(x, y int) color.Color {
+	size, drawn := p.size(), p.drawnSize()
+	return p.current().At(x*drawn.X/size.X, y*drawn.Y/size.Y)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"image"
+	"testing"
+)
+
+func TestIsSVG(t *testing.T) {
+	tests := []struct {
+		data string
+		svg  bool
+	}{
+		{`<svg xmlns="http://www.w3.org/2000/svg"/>`, true},
+		{`<svg>`, true},
+		{"\xef\xbb\xbf<svg>", true},
+		{"  \n<?xml version=\"1.0\"?>\n<!-- made by hand -->\n<svg>", true},
+		{`<!DOCTYPE svg PUBLIC "-//W3C//DTD SVG 1.1//EN" "http://www.w3.org/Graphics/SVG/1.1/DTD/svg11.dtd"><svg>`, true},
+		{`<!DOCTYPE svg [<!ENTITY a "<b>">]><svg>`, true},
+		{`<svgx>`, false},
+		{`<svg`, false},
+		{`<html><svg>`, false},
+		{`<!-- <svg> not closed`, false},
+		{`<?xml version="1.0"`, false},
+		{"\x89PNG\r\n\x1a\n<svg>", false},
+		{"GIF89a<svg>", false},
+		{"", false},
+	}
+
+	for _, test := range tests {
+		if got := isSVG([]byte(test.data)); got != test.svg {
+			t.Errorf("isSVG(%q) = %t, want %t", test.data, got, test.svg)
+		}
+	}
+}
+
+func TestDrawnSize(t *testing.T) {
+	defer func(width, height int) { colWidth, rowHeight = width, height }(colWidth, rowHeight)
+
+	tests := []struct {
+		cols, rows          int
+		colWidth, rowHeight int
+		want                image.Point
+	}{
+		{10, 5, 10, 20, image.Pt(100, 100)},
+		{2000, 1000, 10, 20, image.Pt(8192, 8192)},
+		{4000, 100, 10, 20, image.Pt(16384, 819)},
+		{1, 1, 1, 1, image.Pt(1, 1)},
+	}
+
+	for _, test := range tests {
+		colWidth, rowHeight = test.colWidth, test.rowHeight
+		p := &vectorPlacement{cols: test.cols, rows: test.rows}
+
+		if got := p.drawnSize(); got != test.want {
+			t.Errorf("%d x %d cells of %d x %d pixels drawn at %v, want %v", test.cols, test.rows, test.colWidth,
+				test.rowHeight, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"image/color"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+// theme holds the colors cells can refer to instead of using a fixed color
+type theme struct {
+	foreground color.RGBA
+	background color.RGBA
+	cursor     color.RGBA
+	selection  color.RGBA
+	ansi       [16]color.RGBA
+}
+
+var (
+	themes = map[string]theme{
+		"default": {
+			foreground: rgb(0xffffff),
+			background: rgb(0x000000),
+			cursor:     rgb(0xffffff),
+			selection:  rgb(0x4d4d4d),
+			ansi:       xtermColors(),
+		},
+		"light": {
+			foreground: rgb(0x000000),
+			background: rgb(0xffffff),
+			cursor:     rgb(0x000000),
+			selection:  rgb(0xb5d5ff),
+			ansi:       xtermColors(),
+		},
+		"solarizedDark": {
+			foreground: rgb(0x839496),
+			background: rgb(0x002b36),
+			cursor:     rgb(0x93a1a1),
+			selection:  rgb(0x073642),
+			ansi: [16]color.RGBA{
+				rgb(0x073642), rgb(0xdc322f), rgb(0x859900), rgb(0xb58900),
+				rgb(0x268bd2), rgb(0xd33682), rgb(0x2aa198), rgb(0xeee8d5),
+				rgb(0x002b36), rgb(0xcb4b16), rgb(0x586e75), rgb(0x657b83),
+				rgb(0x839496), rgb(0x6c71c4), rgb(0x93a1a1), rgb(0xfdf6e3),
+			},
+		},
+	}
+
+	// currentTheme is only touched from the main thread
+	currentTheme = themes["default"]
+)
+
+func xtermColors() [16]color.RGBA {
+	var ansi [16]color.RGBA
+	copy(ansi[:], palette[:16])
+	return ansi
+}
+
+func rgb(hex uint32) color.RGBA {
+	return color.RGBA{R: uint8(hex >> 16), G: uint8(hex >> 8), B: uint8(hex), A: 255}
+}
+
+// themeRequest is both the theme request and the format of theme files.
+// The theme is based on the named theme, or the current one if there is no name, with the colors sent replacing its colors
+type themeRequest struct {
+	Name       *string         `json:"name"`
+	Foreground *requestColor   `json:"foreground"`
+	Background *requestColor   `json:"background"`
+	Cursor     *requestColor   `json:"cursor"`
+	Selection  *requestColor   `json:"selection"`
+	ANSI       []*requestColor `json:"ansi"`
+}
+
+func (req themeRequest) validate() error {
+	if req.Name != nil {
+		if _, ok := themes[*req.Name]; !ok {
+			return errors.Errorf("theme request got unknown theme name %q", *req.Name)
+		}
+	}
+
+	if len(req.ANSI) > 16 {
+		return errors.New("theme request got more than 16 ansi colors")
+	}
+
+	colors := append([]*requestColor{req.Foreground, req.Background, req.Cursor, req.Selection}, req.ANSI...)
+
+	for _, c := range colors {
+		if c != nil && c.index != colorFixed && c.index < 16 {
+			return errors.New("theme request colors can not refer to the theme itself")
+		}
+	}
+
+	return nil
+}
+
+// theme returns the theme the request describes, based on the current theme
+func (req themeRequest) theme() theme {
+	t := currentTheme
+
+	if req.Name != nil {
+		t = themes[*req.Name]
+	}
+
+	set := func(dst *color.RGBA, c *requestColor) {
+		if c != nil {
+			*dst = cellColor(*c).resolve()
+		}
+	}
+
+	set(&t.foreground, req.Foreground)
+	set(&t.background, req.Background)
+	set(&t.cursor, req.Cursor)
+	set(&t.selection, req.Selection)
+
+	for i, c := range req.ANSI {
+		set(&t.ansi[i], c)
+	}
+
+	return t
+}
+
+// loadTheme reads a theme file, in the same format as the theme request
+func loadTheme(path string) (themeRequest, error) {
+	var req themeRequest
+
+	data, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return req, errors.WithMessage(err, "could not read theme file")
+	}
+
+	err = json.Unmarshal(data, &req)
+
+	if err != nil {
+		return req, errors.WithMessage(err, "could not parse theme file")
+	}
+
+	return req, req.validate()
+}
+
+// themeDrawRequest switches theme, every cell referring to the theme is recolored
+type themeDrawRequest struct {
+	req themeRequest
+}
+
+func (req themeDrawRequest) apply(*grid) {
+	currentTheme = req.req.theme()
+
+	for _, g := range grids() {
+		g.markAllDirty()
+	}
+}